@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"rmazur.io/overseer/state"
+)
+
+func init() {
+	state.Register("File", &File{}, state.Metadata{
+		Description: "Local file with the given content.",
+		Fields: map[string]string{
+			"Path":    "Path of the file.",
+			"Content": "Content written to the file.",
+			"Mode":    "File permissions, 0644 by default.",
+		},
+	})
+}
+
+// File is a built-in resource kind managing a local file.
+type File struct {
+	Path    string      `json:"path" state:"id"`
+	Content string      `json:"content" state:"Write"`
+	Mode    os.FileMode `json:"mode,omitempty" state:"Chmod"`
+}
+
+func (f *File) mode() os.FileMode {
+	if f.Mode == 0 {
+		return 0644
+	}
+	return f.Mode
+}
+
+func (f *File) Create(ctx context.Context) error {
+	if err := ioutil.WriteFile(f.Path, []byte(f.Content), f.mode()); err != nil {
+		return err
+	}
+	return os.Chmod(f.Path, f.mode())
+}
+
+func (f *File) Remove(ctx context.Context) error {
+	err := os.Remove(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *File) Write(ctx context.Context, prev string) error {
+	return ioutil.WriteFile(f.Path, []byte(f.Content), f.mode())
+}
+
+func (f *File) Chmod(ctx context.Context, prev os.FileMode) error {
+	return os.Chmod(f.Path, f.mode())
+}
+
+// Rename moves the file when its path is changed without changing the content.
+func (f *File) Rename(ctx context.Context, oldId string) error {
+	path, err := state.ParsePath(oldId)
+	if err != nil {
+		return err
+	}
+	if len(path) == 0 {
+		return fmt.Errorf("bad file id %q", oldId)
+	}
+	return os.Rename(path[len(path)-1], f.Path)
+}
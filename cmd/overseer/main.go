@@ -0,0 +1,532 @@
+// Command overseer plans and applies the desired state described in configuration files.
+//
+// Usage:
+//
+//	overseer [-state file] <command> [flags] [config path]
+//
+// The commands are:
+//
+//	plan     print the changes required to reach the desired state
+//	apply    plan the changes, ask for a confirmation, and perform them
+//	show     print the last applied state
+//	destroy  remove everything listed in the last applied state
+//	schema   print the JSON Schema of the configuration files
+//
+// The config path is a YAML or JSON file, or a directory with such files, see package config for the format.
+// The last applied state is kept in the state file, which is .overseer.state.json by default.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rmazur.io/overseer/config"
+	"rmazur.io/overseer/state"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func newDecoder() *config.Decoder {
+	return config.NewRegistryDecoder(state.DefaultRegistry)
+}
+
+const usage = `Usage: overseer [-state file] <command> [flags] [config path]
+
+Commands:
+  plan     print the changes required to reach the desired state
+  apply    plan the changes, ask for a confirmation, and perform them
+  show     print the last applied state
+  destroy  remove everything listed in the last applied state
+  schema   print the JSON Schema of the configuration files
+`
+
+type cli struct {
+	decoder   *config.Decoder
+	statePath string
+
+	in       io.Reader
+	out, err io.Writer
+}
+
+func run(args []string, in io.Reader, out, errOut io.Writer) int {
+	c := &cli{decoder: newDecoder(), in: in, out: out, err: errOut}
+
+	fs := flag.NewFlagSet("overseer", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	fs.Usage = func() {
+		fmt.Fprint(errOut, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&c.statePath, "state", ".overseer.state.json", "path to the file with the last applied state")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	commands := map[string]func(ctx context.Context, args []string) error{
+		"plan":    c.plan,
+		"apply":   c.apply,
+		"show":    c.show,
+		"destroy": c.destroy,
+		"schema":  c.schema,
+	}
+	command, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(errOut, "Unknown command %s\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	if err := command(context.Background(), fs.Args()[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(errOut, "Error:", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+type listFlag []string
+
+func (lf *listFlag) String() string {
+	return strings.Join(*lf, ",")
+}
+
+func (lf *listFlag) Set(value string) error {
+	*lf = append(*lf, value)
+	return nil
+}
+
+// movedFlag collects the moves declared in the from=to form.
+type movedFlag map[string]string
+
+func (mf movedFlag) String() string {
+	res := make([]string, 0, len(mf))
+	for from, to := range mf {
+		res = append(res, from+"="+to)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+func (mf movedFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad move %s, expected from=to", value)
+	}
+	mf[parts[0]] = parts[1]
+	return nil
+}
+
+func (mf movedFlag) options() []state.PlanOption {
+	res := make([]state.PlanOption, 0, len(mf))
+	for from, to := range mf {
+		res = append(res, state.Moved(from, to))
+	}
+	return res
+}
+
+// desiredFlags define how the desired state is loaded.
+type desiredFlags struct {
+	overlays listFlag
+	vars     listFlag
+}
+
+func (df *desiredFlags) register(fs *flag.FlagSet) {
+	fs.Var(&df.overlays, "overlay", "file or directory with the documents patching the config, can be repeated")
+	fs.Var(&df.vars, "var", "variable in the name=value form, can be repeated")
+}
+
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.err)
+	return fs
+}
+
+// configPath returns the config path passed to the command, the current directory by default.
+func configPath(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() > 1 {
+		return "", fmt.Errorf("only one config path is expected, got %s", fs.Args())
+	}
+	if fs.NArg() == 1 {
+		return fs.Arg(0), nil
+	}
+	return ".", nil
+}
+
+// checkOutside verifies that the file written by the command is not read as a part of the config.
+func checkOutside(fs *flag.FlagSet, file string) error {
+	path, err := configPath(fs)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return err
+	}
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is inside the config directory %s, choose another path", file, path)
+	}
+	return nil
+}
+
+func (c *cli) loadDesired(fs *flag.FlagSet, df *desiredFlags) ([]config.Document, state.Set, error) {
+	path, err := configPath(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.decoder.Vars = make(map[string]interface{}, len(df.vars))
+	for _, v := range df.vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("bad variable %s, expected name=value", v)
+		}
+		c.decoder.Vars[parts[0]] = parts[1]
+	}
+
+	docs, err := c.decoder.ReadOverlays(path, df.overlays...)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := config.BuildSet(docs)
+	return docs, items, err
+}
+
+func (c *cli) loadApplied() ([]config.Document, state.Set, error) {
+	if _, err := os.Stat(c.statePath); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	docs, err := c.decoder.ReadFile(c.statePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := config.BuildSet(docs)
+	return docs, items, err
+}
+
+func (c *cli) saveApplied(docs []config.Document) error {
+	f, err := ioutil.TempFile(filepath.Dir(c.statePath), ".overseer-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := config.Encode(f, docs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.statePath)
+}
+
+func (c *cli) printPlan(p *state.Plan) {
+	if p.Empty() {
+		fmt.Fprintln(c.out, "No changes.")
+	} else {
+		fmt.Fprint(c.out, p)
+	}
+}
+
+func (c *cli) plan(ctx context.Context, args []string) error {
+	var (
+		df      desiredFlags
+		outPath string
+		moved   = make(movedFlag)
+	)
+	fs := c.flagSet("plan")
+	df.register(fs)
+	fs.Var(moved, "moved", "ID of the moved item in the from=to form, can be repeated")
+	fs.StringVar(&outPath, "out", "", "save the plan to the file outside of the config directory to apply it later")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if outPath != "" {
+		if err := checkOutside(fs, outPath); err != nil {
+			return err
+		}
+	}
+
+	_, prev, err := c.loadApplied()
+	if err != nil {
+		return err
+	}
+	_, next, err := c.loadDesired(fs, &df)
+	if err != nil {
+		return err
+	}
+	p, err := state.NewPlan(prev, next, moved.options()...)
+	if err != nil {
+		return err
+	}
+	c.printPlan(p)
+
+	if outPath != "" {
+		data, err := json.MarshalIndent(p.Save(), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(outPath, data, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "Plan is saved to %s.\n", outPath)
+	}
+	return nil
+}
+
+func (c *cli) apply(ctx context.Context, args []string) error {
+	var (
+		df          desiredFlags
+		planPath    string
+		autoApprove bool
+		maxRemoves  int
+		moved       = make(movedFlag)
+	)
+	fs := c.flagSet("apply")
+	df.register(fs)
+	fs.Var(moved, "moved", "ID of the moved item in the from=to form, can be repeated")
+	fs.StringVar(&planPath, "plan", "", "apply the plan saved with plan -out, it must not be stale")
+	fs.BoolVar(&autoApprove, "auto-approve", false, "do not ask for a confirmation")
+	fs.IntVar(&maxRemoves, "max-removes", -1, "fail if the plan removes more items than the limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if planPath != "" && (maxRemoves >= 0 || len(moved) > 0) {
+		return errors.New("-max-removes and -moved cannot be used with -plan, pass them to the plan command")
+	}
+	if planPath != "" {
+		c.decoder.Exclude = append(c.decoder.Exclude, planPath)
+	}
+
+	prevDocs, prev, err := c.loadApplied()
+	if err != nil {
+		return err
+	}
+	docs, next, err := c.loadDesired(fs, &df)
+	if err != nil {
+		return err
+	}
+
+	var p *state.Plan
+	if planPath != "" {
+		data, err := ioutil.ReadFile(planPath)
+		if err != nil {
+			return err
+		}
+		var saved state.SavedPlan
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("bad plan file %s: %w", planPath, err)
+		}
+		if p, err = saved.Bind(prev, next); err != nil {
+			return err
+		}
+		// The saved plan is already reviewed.
+		autoApprove = true
+	} else if p, err = state.NewPlan(prev, next, append(moved.options(), state.MaxRemoves(maxRemoves))...); err != nil {
+		return err
+	}
+
+	if p.Empty() {
+		c.printPlan(p)
+		return c.saveApplied(docs)
+	}
+	if err := c.perform(ctx, p, autoApprove, prevDocs, docs); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "Apply complete.")
+	return nil
+}
+
+// perform applies the plan and saves the next documents as the applied state.
+// If the plan fails partway, the state is saved with the documents of the performed changes only.
+func (c *cli) perform(ctx context.Context, p *state.Plan, autoApprove bool, prev, next []config.Document) error {
+	performed := make(map[string]bool)
+	e := &state.Executor{
+		Approver: &state.TerminalApprover{In: c.in, Out: c.out, AutoApprove: autoApprove},
+		Report: func(f state.Finding) {
+			fmt.Fprintln(c.err, f)
+		},
+		Performed: func(ch state.Change) {
+			performed[ch.Id()] = true
+			if ch.Before != nil {
+				performed[ch.Before.Id()] = true
+			}
+		},
+	}
+	err := e.Apply(ctx, p)
+	if errors.Is(err, state.ErrNotApproved) {
+		return errors.New("cancelled")
+	}
+	if err == nil {
+		return c.saveApplied(next)
+	}
+	if len(performed) == 0 {
+		return err
+	}
+	docs, stateErr := partialState(prev, next, performed)
+	if stateErr == nil {
+		stateErr = c.saveApplied(docs)
+	}
+	if stateErr != nil {
+		return fmt.Errorf("%w (cannot save the performed changes: %v)", err, stateErr)
+	}
+	return fmt.Errorf("%w (the performed changes are saved)", err)
+}
+
+// partialState returns the applied documents after some of the changes are performed: the previous documents
+// not affected by the performed changes and the next documents created or updated by them.
+func partialState(prev, next []config.Document, performed map[string]bool) ([]config.Document, error) {
+	done := func(id string) bool {
+		// Changes of the parents cover the nested parts.
+		for {
+			if performed[id] {
+				return true
+			}
+			i := strings.LastIndex(id, "/")
+			if i <= 0 {
+				return false
+			}
+			id = id[:i]
+		}
+	}
+
+	var res []config.Document
+	for _, docs := range []struct {
+		list []config.Document
+		keep bool
+	}{{prev, false}, {next, true}} {
+		ids, err := documentIds(docs.list)
+		if err != nil {
+			return nil, err
+		}
+		for i, doc := range docs.list {
+			if done(ids[i]) == docs.keep {
+				res = append(res, doc)
+			}
+		}
+	}
+	return res, nil
+}
+
+// documentIds returns the IDs of the state items built from the documents.
+func documentIds(docs []config.Document) ([]string, error) {
+	byKind := make(map[string][]int)
+	for i, doc := range docs {
+		byKind[doc.Kind] = append(byKind[doc.Kind], i)
+	}
+	res := make([]string, len(docs))
+	for _, indexes := range byKind {
+		kindDocs := make([]config.Document, len(indexes))
+		for i, index := range indexes {
+			kindDocs[i] = docs[index]
+		}
+		items, err := config.BuildSet(kindDocs)
+		if err != nil {
+			return nil, err
+		}
+		kind, ok := items[0].(state.ComposedItem)
+		if len(items) != 1 || !ok || len(kind.Parts) != len(indexes) {
+			return nil, fmt.Errorf("cannot identify the %s documents", kindDocs[0].Kind)
+		}
+		for i, index := range indexes {
+			res[index] = kind.Parts[i].Id()
+		}
+	}
+	return res, nil
+}
+
+func (c *cli) show(ctx context.Context, args []string) error {
+	fs := c.flagSet("show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, applied, err := c.loadApplied()
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintln(c.out, "No state.")
+		return nil
+	}
+	c.printItems(applied)
+	return nil
+}
+
+func (c *cli) printItems(items []state.Item) {
+	for _, item := range items {
+		csi, composed := item.(state.ComposedItem)
+		if composed {
+			fmt.Fprintln(c.out, item.Id())
+			c.printItems(csi.Parts)
+		} else if v, ok := state.Value(item); ok {
+			fmt.Fprintf(c.out, "%s = %v\n", item.Id(), v)
+		} else {
+			fmt.Fprintln(c.out, item.Id())
+		}
+	}
+}
+
+func (c *cli) destroy(ctx context.Context, args []string) error {
+	var autoApprove bool
+	fs := c.flagSet("destroy")
+	fs.BoolVar(&autoApprove, "auto-approve", false, "do not ask for a confirmation")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	prevDocs, prev, err := c.loadApplied()
+	if err != nil {
+		return err
+	}
+	p, err := state.NewPlan(prev, nil)
+	if err != nil {
+		return err
+	}
+	if p.Empty() {
+		c.printPlan(p)
+		return nil
+	}
+	if err := c.perform(ctx, p, autoApprove, prevDocs, nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "Destroy complete.")
+	return nil
+}
+
+func (c *cli) schema(ctx context.Context, args []string) error {
+	fs := c.flagSet("schema")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s, err := c.decoder.JSONSchema()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\n", data)
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"rmazur.io/overseer/state"
+)
+
+type testEnv struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "overseer-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	if err := os.Mkdir(filepath.Join(dir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{t: t, dir: dir}
+}
+
+func (te *testEnv) path(name string) string {
+	return filepath.Join(te.dir, name)
+}
+
+func (te *testEnv) writeConfig(content string) {
+	if err := ioutil.WriteFile(te.path("config/files.yaml"), []byte(content), 0644); err != nil {
+		te.t.Fatal(err)
+	}
+}
+
+func (te *testEnv) run(input string, args ...string) string {
+	var out, errOut bytes.Buffer
+	args = append([]string{"-state", te.path("state.json")}, args...)
+	if code := run(args, strings.NewReader(input), &out, &errOut); code != 0 {
+		te.t.Fatalf("overseer %s failed with code %d: %s", args, code, errOut.String())
+	}
+	return out.String()
+}
+
+func (te *testEnv) assertFile(name, content string) {
+	data, err := ioutil.ReadFile(te.path(name))
+	if err != nil {
+		te.t.Fatal(err)
+	}
+	if string(data) != content {
+		te.t.Errorf("Unexpected content of %s: %s", name, data)
+	}
+}
+
+func TestRun(t *testing.T) {
+	te := newTestEnv(t)
+	te.writeConfig(`
+kind: File
+path: ` + te.path("a.txt") + `
+content: hello ${name}
+`)
+
+	out := te.run("", "plan", "-var", "name=world", te.path("config"))
+	if !strings.Contains(out, "/Content = hello world") || !strings.Contains(out, "Plan: 4 to create") {
+		t.Errorf("Unexpected plan output:\n%s", out)
+	}
+
+	// Cancelled.
+	var errOut bytes.Buffer
+	code := run([]string{"-state", te.path("state.json"), "apply", "-var", "name=world", te.path("config")},
+		strings.NewReader("no\n"), ioutil.Discard, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "cancelled") {
+		t.Errorf("Unexpected result of cancelled apply: %d, %s", code, errOut.String())
+	}
+	if _, err := os.Stat(te.path("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("File is created by cancelled apply: %v", err)
+	}
+
+	out = te.run("yes\n", "apply", "-var", "name=world", te.path("config"))
+	if !strings.Contains(out, "Apply complete.") {
+		t.Errorf("Unexpected apply output:\n%s", out)
+	}
+	te.assertFile("a.txt", "hello world")
+
+	out = te.run("", "show")
+	if !strings.Contains(out, "/Content = hello world") {
+		t.Errorf("Unexpected show output:\n%s", out)
+	}
+
+	out = te.run("", "plan", "-var", "name=world", te.path("config"))
+	if !strings.Contains(out, "No changes.") {
+		t.Errorf("Unexpected plan output:\n%s", out)
+	}
+
+	// Saved plan.
+	te.run("", "plan", "-var", "name=overseer", "-out", te.path("plan.json"), te.path("config"))
+	out = te.run("", "apply", "-var", "name=overseer", "-plan", te.path("plan.json"), te.path("config"))
+	if !strings.Contains(out, "(Write): hello world -> hello overseer") {
+		t.Errorf("Unexpected apply output:\n%s", out)
+	}
+	te.assertFile("a.txt", "hello overseer")
+
+	// The plan flags are not applied to the saved plan.
+	code = run([]string{"-state", te.path("state.json"), "apply", "-max-removes", "0", "-plan", te.path("plan.json"), te.path("config")},
+		strings.NewReader(""), ioutil.Discard, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "cannot be used with -plan") {
+		t.Errorf("Unexpected result of saved plan apply with flags: %d, %s", code, errOut.String())
+	}
+
+	// The saved plan is stale now.
+	code = run([]string{"-state", te.path("state.json"), "apply", "-var", "name=overseer", "-plan", te.path("plan.json"), te.path("config")},
+		strings.NewReader(""), ioutil.Discard, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "stale") {
+		t.Errorf("Unexpected result of stale plan apply: %d, %s", code, errOut.String())
+	}
+
+	out = te.run("", "destroy", "-auto-approve")
+	if !strings.Contains(out, "Destroy complete.") {
+		t.Errorf("Unexpected destroy output:\n%s", out)
+	}
+	if _, err := os.Stat(te.path("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("File is not removed: %v", err)
+	}
+	out = te.run("", "show")
+	if !strings.Contains(out, "No state.") {
+		t.Errorf("Unexpected show output:\n%s", out)
+	}
+}
+
+func TestRun_Schema(t *testing.T) {
+	te := newTestEnv(t)
+	out := te.run("", "schema")
+	if !strings.Contains(out, `"const": "File"`) || !strings.Contains(out, `"x-state-id": "path"`) {
+		t.Errorf("Unexpected schema output:\n%s", out)
+	}
+}
+
+func TestRun_Move(t *testing.T) {
+	te := newTestEnv(t)
+	te.writeConfig(`
+kind: File
+path: ` + te.path("a.txt") + `
+content: hello
+`)
+	te.run("", "apply", "-auto-approve", te.path("config"))
+
+	// The rename of the file with the same content is detected.
+	te.writeConfig(`
+kind: File
+path: ` + te.path("b.txt") + `
+content: hello
+`)
+	out := te.run("", "apply", "-auto-approve", te.path("config"))
+	if !strings.Contains(out, "  > ") || !strings.Contains(out, "1 to move.") {
+		t.Errorf("Unexpected apply output:\n%s", out)
+	}
+	te.assertFile("b.txt", "hello")
+	if _, err := os.Stat(te.path("a.txt")); !os.IsNotExist(err) {
+		t.Errorf("File is not moved: %v", err)
+	}
+
+	// The move is declared when the content changes too.
+	te.writeConfig(`
+kind: File
+path: ` + te.path("c.txt") + `
+content: bye
+`)
+	from := state.Path{"File", te.path("b.txt")}.String()
+	to := state.Path{"File", te.path("c.txt")}.String()
+	out = te.run("", "apply", "-auto-approve", "-moved", from+"="+to, te.path("config"))
+	if !strings.Contains(out, "  > "+from+" -> "+to+"\n") || !strings.Contains(out, "(Write): hello -> bye") {
+		t.Errorf("Unexpected apply output:\n%s", out)
+	}
+	te.assertFile("c.txt", "bye")
+	if _, err := os.Stat(te.path("b.txt")); !os.IsNotExist(err) {
+		t.Errorf("File is not moved: %v", err)
+	}
+}
+
+func TestRun_PartialApply(t *testing.T) {
+	te := newTestEnv(t)
+	te.writeConfig(`
+kind: File
+path: ` + te.path("a.txt") + `
+content: a
+`)
+	te.run("", "apply", "-auto-approve", te.path("config"))
+
+	te.writeConfig(`
+kind: File
+path: ` + te.path("a.txt") + `
+content: a
+---
+kind: File
+path: ` + te.path("b.txt") + `
+content: b
+---
+kind: File
+path: ` + te.path("missing/c.txt") + `
+content: c
+`)
+	var errOut bytes.Buffer
+	code := run([]string{"-state", te.path("state.json"), "apply", "-auto-approve", te.path("config")},
+		strings.NewReader(""), ioutil.Discard, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "the performed changes are saved") {
+		t.Errorf("Unexpected result of failed apply: %d, %s", code, errOut.String())
+	}
+	te.assertFile("b.txt", "b")
+
+	out := te.run("", "show")
+	id := func(name string) string {
+		return state.Path{"File", te.path(name)}.String() + "\n"
+	}
+	if !strings.Contains(out, id("a.txt")) || !strings.Contains(out, id("b.txt")) ||
+		strings.Contains(out, id("missing/c.txt")) {
+		t.Errorf("Unexpected show output:\n%s", out)
+	}
+}
+
+func TestRun_DefaultConfigPath(t *testing.T) {
+	te := newTestEnv(t)
+	te.writeConfig(`
+kind: File
+path: ` + te.path("a.txt") + `
+content: hello
+`)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(te.path("config")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	var errOut bytes.Buffer
+	code := run([]string{"-state", te.path("state.json"), "plan", "-out", "plan.json"},
+		strings.NewReader(""), ioutil.Discard, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "inside the config directory") {
+		t.Errorf("Unexpected result of saving the plan into the config: %d, %s", code, errOut.String())
+	}
+
+	// A plan file put into the config directory is not read as a config.
+	te.run("", "plan", "-out", te.path("plan.json"))
+	data, err := ioutil.ReadFile(te.path("plan.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("plan.json", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	te.run("", "apply", "-plan", "plan.json")
+	te.assertFile("a.txt", "hello")
+}
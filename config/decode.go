@@ -0,0 +1,293 @@
+// Package config loads desired state from YAML and JSON documents.
+//
+// Every document is a mapping with a kind field selecting one of the registered Go types.
+// The rest of the document fields are decoded into a value of that type using its json field tags:
+//
+//	kind: House
+//	id: house A
+//	address: 5 Cherry lane
+//
+// Decoded values are converted to state items with state.BuildStateItems,
+// so the state tags of the registered types work the same way as for Go literals.
+package config // import "rmazur.io/overseer/config"
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"rmazur.io/overseer/state"
+)
+
+// KindField is the name of the document field selecting the registered type.
+const KindField = "kind"
+
+// Format is an encoding of the configuration documents.
+type Format int
+
+const (
+	JSON Format = iota + 1
+	YAML
+)
+
+// FormatOf detects the format of a file by its extension.
+func FormatOf(path string) (Format, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return JSON, true
+	case ".yaml", ".yml":
+		return YAML, true
+	default:
+		return 0, false
+	}
+}
+
+// Document is a desired state document decoded into a registered type.
+type Document struct {
+	Kind string
+	// Value is a pointer to the decoded value of the registered type.
+	Value interface{}
+	// Source describes where the document is read from.
+	Source string
+}
+
+// Decoder decodes documents into the registered types.
+type Decoder struct {
+	// Vars are substituted for the ${name} references in the documents.
+	// They take precedence over the values defined with the Variables documents.
+	Vars map[string]interface{}
+	// Exclude lists the files that are never read, like the files written next to the configuration.
+	Exclude []string
+
+	registry *state.Registry
+}
+
+// NewDecoder returns a decoder with its own set of registered kinds.
+func NewDecoder() *Decoder {
+	return NewRegistryDecoder(state.NewRegistry())
+}
+
+// NewRegistryDecoder returns a decoder that maps the document kinds to the resource types of the registry.
+// Types registered under the reserved Include and Variables names are never used.
+func NewRegistryDecoder(r *state.Registry) *Decoder {
+	return &Decoder{registry: r}
+}
+
+// Register maps the documents of the given kind to the type of the prototype value.
+// The prototype should be a struct or a pointer to a struct.
+// Register panics if the kind is reserved, or if the type cannot be registered in the decoder registry.
+func (d *Decoder) Register(kind string, prototype interface{}) {
+	if kind == IncludeKind || kind == VariablesKind {
+		panic("config: kind " + kind + " is reserved")
+	}
+	if err := d.registry.Register(kind, prototype, state.Metadata{}); err != nil {
+		panic("config: " + err.Error())
+	}
+}
+
+func (d *Decoder) kindType(kind string) (reflect.Type, bool) {
+	rt, ok := d.registry.Lookup(kind)
+	if !ok {
+		return nil, false
+	}
+	return rt.Type, true
+}
+
+// Decode reads all the documents from r.
+// JSON input may contain a sequence of objects or arrays of objects.
+// YAML input may contain several documents, each of them being a mapping or a sequence of mappings.
+// The source is used to describe the documents location in errors.
+func (d *Decoder) Decode(r io.Reader, format Format, source string) ([]Document, error) {
+	raws, err := parseDocuments(r, format, source)
+	if err != nil {
+		return nil, err
+	}
+	if raws, err = d.interpolate(raws); err != nil {
+		return nil, err
+	}
+	return d.decodeDocuments(raws)
+}
+
+// rawDocument is a parsed document, which is not decoded into a registered type yet.
+type rawDocument struct {
+	kind   string
+	fields map[string]interface{}
+	source string
+}
+
+func parseDocuments(r io.Reader, format Format, source string) ([]rawDocument, error) {
+	var values []interface{}
+	switch format {
+	case JSON:
+		jd := json.NewDecoder(r)
+		for {
+			var value interface{}
+			if err := jd.Decode(&value); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			values = append(values, value)
+		}
+	case YAML:
+		yd := yaml.NewDecoder(r)
+		for {
+			var value interface{}
+			if err := yd.Decode(&value); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", source, err)
+			}
+			values = append(values, value)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown format %d", source, format)
+	}
+
+	var res []rawDocument
+	for _, value := range values {
+		list, ok := value.([]interface{})
+		if !ok {
+			if value == nil {
+				continue
+			}
+			list = []interface{}{value}
+		}
+		for _, item := range list {
+			raw, err := parseDocument(item, fmt.Sprintf("%s#%d", source, len(res)))
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, raw)
+		}
+	}
+	return res, nil
+}
+
+func parseDocument(value interface{}, source string) (rawDocument, error) {
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		return rawDocument{}, fmt.Errorf("%s: document is not a mapping", source)
+	}
+	kind, ok := fields[KindField].(string)
+	if !ok {
+		return rawDocument{}, fmt.Errorf("%s: document has no %s", source, KindField)
+	}
+	delete(fields, KindField)
+	return rawDocument{kind: kind, fields: fields, source: source}, nil
+}
+
+func (d *Decoder) decodeDocuments(raws []rawDocument) ([]Document, error) {
+	res := make([]Document, len(raws))
+	for i, raw := range raws {
+		var err error
+		if res[i], err = d.decodeDocument(raw); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (d *Decoder) decodeDocument(raw rawDocument) (Document, error) {
+	if raw.kind == IncludeKind {
+		return decodeInclude(raw)
+	}
+	t, ok := d.kindType(raw.kind)
+	if !ok {
+		return Document{}, fmt.Errorf("%s: unknown kind %q", raw.source, raw.kind)
+	}
+
+	data, err := json.Marshal(raw.fields)
+	if err != nil {
+		return Document{}, fmt.Errorf("%s: %w", raw.source, err)
+	}
+	value := reflect.New(t)
+	jd := json.NewDecoder(bytes.NewReader(data))
+	jd.DisallowUnknownFields()
+	if err := jd.Decode(value.Interface()); err != nil {
+		return Document{}, fmt.Errorf("%s: bad %s document: %w", raw.source, raw.kind, err)
+	}
+	return Document{Kind: raw.kind, Value: value.Interface(), Source: raw.source}, nil
+}
+
+// BuildSet converts the documents to state items with state.BuildStateItems.
+// Documents are grouped by kind, so the item IDs are prefixed with the kind name.
+// Within a kind, the documents are identified by their `state:"id"` fields or their position.
+// A *DuplicateError is returned if several documents have the same ID.
+func BuildSet(docs []Document) (state.Set, error) {
+	groups := make(map[string]reflect.Value)
+	for _, doc := range docs {
+		if doc.Kind == IncludeKind {
+			return nil, fmt.Errorf("%s: include is not resolved, use Decoder.Read to resolve includes", doc.Source)
+		}
+		v := reflect.ValueOf(doc.Value)
+		group, present := groups[doc.Kind]
+		if !present {
+			group = reflect.MakeSlice(reflect.SliceOf(v.Type()), 0, 1)
+		}
+		groups[doc.Kind] = reflect.Append(group, v)
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	input := make(map[string]interface{}, len(groups))
+	for kind, group := range groups {
+		input[kind] = group.Interface()
+	}
+	items, err := state.BuildStateItems(input)
+	if err != nil {
+		return nil, duplicateError(docs, err)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Id() < items[j].Id()
+	})
+	return items, nil
+}
+
+// DuplicateError is returned by BuildSet when several documents have the same ID.
+type DuplicateError struct {
+	Id string
+	// Sources of the documents sharing the ID.
+	Sources []string
+}
+
+func (de *DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate id %s in %s", de.Id, strings.Join(de.Sources, " and "))
+}
+
+// duplicateError converts the state error about the duplicate documents to a DuplicateError.
+func duplicateError(docs []Document, err error) error {
+	var de *state.DuplicateIdError
+	if !errors.As(err, &de) {
+		return err
+	}
+	path, pathErr := state.ParsePath(de.Parent)
+	if pathErr != nil || len(path) != 1 {
+		// Collision inside a document.
+		return err
+	}
+	kind := path[0]
+
+	res := &DuplicateError{Id: de.Id}
+	i := 0
+	for _, doc := range docs {
+		if doc.Kind != kind {
+			continue
+		}
+		for _, index := range de.Indexes {
+			if index == i {
+				res.Sources = append(res.Sources, doc.Source)
+			}
+		}
+		i++
+	}
+	return res
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"rmazur.io/overseer/state"
+)
+
+var performed []string
+
+type testRoom struct {
+	Name  string `json:"name" state:"id"`
+	Color string `json:"color" state:"Repaint"`
+}
+
+func (r *testRoom) Create(context.Context) error {
+	performed = append(performed, "create room "+r.Name)
+	return nil
+}
+
+func (r *testRoom) Remove(context.Context) error {
+	performed = append(performed, "remove room "+r.Name)
+	return nil
+}
+
+func (r *testRoom) Repaint(ctx context.Context, prev string) error {
+	performed = append(performed, fmt.Sprintf("repaint room %s from %s to %s", r.Name, prev, r.Color))
+	return nil
+}
+
+type testHouse struct {
+	Id      string      `json:"id" state:"id"`
+	Address string      `json:"address"`
+	Rooms   []*testRoom `json:"rooms"`
+	Note    string      `json:"note" state:"-"`
+}
+
+func testDecoder() *Decoder {
+	d := NewDecoder()
+	d.Register("House", &testHouse{})
+	d.Register("Room", testRoom{})
+	return d
+}
+
+func itemIds(items []state.Item) []string {
+	var res []string
+	for _, item := range items {
+		res = append(res, item.Id())
+		if csi, ok := item.(state.ComposedItem); ok {
+			res = append(res, itemIds(csi.Parts)...)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+const yamlConfig = `
+kind: House
+id: house A
+address: 5 Cherry lane
+note: ignored
+rooms:
+  - name: kitchen
+    color: white
+---
+- kind: Room
+  name: garage
+  color: gray
+`
+
+const jsonConfig = `
+{"kind": "House", "id": "house A", "address": "5 Cherry lane", "rooms": [{"name": "kitchen", "color": "red"}]}
+[{"kind": "Room", "name": "garage", "color": "gray"}]
+`
+
+func TestDecoder_Decode(t *testing.T) {
+	d := testDecoder()
+
+	yamlDocs, err := d.Decode(strings.NewReader(yamlConfig), YAML, "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(yamlDocs) != 2 {
+		t.Fatalf("Unexpected documents: %v", yamlDocs)
+	}
+	wantHouse := &testHouse{Id: "house A", Address: "5 Cherry lane", Note: "ignored", Rooms: []*testRoom{{Name: "kitchen", Color: "white"}}}
+	if !reflect.DeepEqual(yamlDocs[0].Value, wantHouse) {
+		t.Errorf("Unexpected house: %#v", yamlDocs[0].Value)
+	}
+	if yamlDocs[1].Kind != "Room" || yamlDocs[1].Source != "test.yaml#1" {
+		t.Errorf("Unexpected room document: %#v", yamlDocs[1])
+	}
+
+	jsonDocs, err := d.Decode(strings.NewReader(jsonConfig), JSON, "test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := BuildSet(yamlDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := BuildSet(jsonDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantIds := []string{
+		"/House", "/House/house A", "/House/house A/Address", "/House/house A/Rooms",
+		"/House/house A/Rooms/kitchen", "/House/house A/Rooms/kitchen/Color",
+		"/Room", "/Room/garage", "/Room/garage/Color",
+	}
+	if got := itemIds(next); !reflect.DeepEqual(got, wantIds) {
+		t.Errorf("Unexpected IDs: got %v, want %v", got, wantIds)
+	}
+
+	performed = nil
+	if err := state.InferActions(prev, next).Do(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"repaint room kitchen from white to red"}
+	if !reflect.DeepEqual(performed, want) {
+		t.Errorf("Unexpected actions: got %v, want %v", performed, want)
+	}
+}
+
+func TestDecoder_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "no kind", input: "id: a", wantErr: "test.yaml#0: document has no kind"},
+		{name: "unknown kind", input: "kind: Castle", wantErr: `test.yaml#0: unknown kind "Castle"`},
+		{name: "unknown field", input: "kind: Room\nsize: 5", wantErr: "test.yaml#0: bad Room document"},
+		{name: "not a mapping", input: "- a\n- b", wantErr: "test.yaml#0: document is not a mapping"},
+		{name: "bad syntax", input: "kind: [", wantErr: "test.yaml: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testDecoder().Decode(strings.NewReader(tt.input), YAML, "test.yaml")
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewRegistryDecoder(t *testing.T) {
+	r := state.NewRegistry()
+	if err := r.Register("Room", &testRoom{}, state.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := NewRegistryDecoder(r).Decode(strings.NewReader("kind: Room\nname: hall"), YAML, "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room, ok := docs[0].Value.(*testRoom); !ok || room.Name != "hall" {
+		t.Errorf("Unexpected document: %#v", docs[0])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a kind twice does not panic")
+		}
+	}()
+	NewRegistryDecoder(r).Register("Room", testRoom{})
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encode writes the documents to w as a JSON array accepted by Decode.
+// The ${ sequences in the string values are escaped, so decoding the output gives the same documents.
+func Encode(w io.Writer, docs []Document) error {
+	list := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		data, err := json.Marshal(doc.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", doc.Source, err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("%s: %s document is not encoded as an object: %w", doc.Source, doc.Kind, err)
+		}
+		fields[KindField] = doc.Kind
+		list[i] = escape(fields)
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(list)
+}
+
+func escape(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = escape(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = escape(item)
+		}
+	case string:
+		return strings.Replace(v, "${", "$${", -1)
+	}
+	return value
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	d := testDecoder()
+	docs, err := d.Decode(strings.NewReader(yamlConfig), YAML, "test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs[0].Value.(*testHouse).Note = "costs ${5}"
+
+	var out bytes.Buffer
+	if err := Encode(&out, docs); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := d.Decode(&out, JSON, "encoded.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(docs) {
+		t.Fatalf("Unexpected decoded documents: %v", decoded)
+	}
+	for i := range docs {
+		if decoded[i].Kind != docs[i].Kind || !reflect.DeepEqual(decoded[i].Value, docs[i].Value) {
+			t.Errorf("Document %d is changed: got %#v, want %#v", i, decoded[i].Value, docs[i].Value)
+		}
+	}
+}
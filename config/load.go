@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"rmazur.io/overseer/state"
+)
+
+// IncludeKind is a reserved document kind used to read other configuration files:
+//
+//	kind: Include
+//	files:
+//	  - ../shared/*.yaml
+//
+// The paths are relative to the including file and may contain glob patterns or point to directories.
+// Included documents are placed where the include document is.
+const IncludeKind = "Include"
+
+// Include is the decoded value of an include document.
+type Include struct {
+	Files []string
+}
+
+func decodeInclude(raw rawDocument) (Document, error) {
+	res := &Include{}
+	for name, value := range raw.fields {
+		if name != "files" {
+			return Document{}, fmt.Errorf("%s: unknown include field %q", raw.source, name)
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return Document{}, fmt.Errorf("%s: include files must be a list", raw.source)
+		}
+		for _, f := range list {
+			path, ok := f.(string)
+			if !ok {
+				return Document{}, fmt.Errorf("%s: include file %v is not a string", raw.source, f)
+			}
+			res.Files = append(res.Files, path)
+		}
+	}
+	return Document{Kind: IncludeKind, Value: res, Source: raw.source}, nil
+}
+
+// Read decodes the documents from the listed files and directories, resolving the includes.
+//
+// Directories are read recursively, files are read in the lexical order of their names.
+// Files with unknown extensions and names starting with a dot are skipped.
+// Every file is read once, at the first place it is referenced at, either by an include or by the directory listing.
+// The files listed in Exclude are not read.
+func (d *Decoder) Read(paths ...string) ([]Document, error) {
+	raws, err := d.readDocuments(paths...)
+	if err != nil {
+		return nil, err
+	}
+	if raws, err = d.interpolate(raws); err != nil {
+		return nil, err
+	}
+	return d.decodeDocuments(raws)
+}
+
+func (d *Decoder) readDocuments(paths ...string) ([]rawDocument, error) {
+	r := &reader{visited: make(map[string]bool)}
+	for _, path := range d.Exclude {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		// Excluded files are skipped as if they were already read.
+		r.visited[abs] = true
+	}
+	for _, path := range paths {
+		if err := r.readPath(path, true); err != nil {
+			return nil, err
+		}
+	}
+	return r.docs, nil
+}
+
+// ReadFile decodes all the documents from the file, detecting its format by the extension.
+func (d *Decoder) ReadFile(path string) ([]Document, error) {
+	return d.Read(path)
+}
+
+// ReadDir decodes all the documents from the configuration files in the directory.
+func (d *Decoder) ReadDir(dir string) ([]Document, error) {
+	return d.Read(dir)
+}
+
+// Load reads the documents from the listed files and directories and merges them into one desired state Set.
+func (d *Decoder) Load(paths ...string) (state.Set, error) {
+	docs, err := d.Read(paths...)
+	if err != nil {
+		return nil, err
+	}
+	return BuildSet(docs)
+}
+
+// LoadFile reads the documents from the file and builds the desired state Set out of them.
+func (d *Decoder) LoadFile(path string) (state.Set, error) {
+	return d.Load(path)
+}
+
+// LoadDir reads the configuration files from the directory and builds the desired state Set out of them.
+func (d *Decoder) LoadDir(dir string) (state.Set, error) {
+	return d.Load(dir)
+}
+
+type reader struct {
+	visited map[string]bool
+	docs    []rawDocument
+}
+
+// readPath reads a file or a directory.
+// Files with unknown extensions are reported only if they are listed explicitly.
+func (r *reader) readPath(path string, explicit bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if r.visited[abs] {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		r.visited[abs] = true
+		return r.readDir(path)
+	}
+	if _, known := FormatOf(path); !known && !explicit {
+		return nil
+	}
+	r.visited[abs] = true
+	return r.readFile(path)
+}
+
+func (r *reader) readDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if err := r.readPath(filepath.Join(dir, entry.Name()), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *reader) readFile(path string) error {
+	format, ok := FormatOf(path)
+	if !ok {
+		return fmt.Errorf("%s: unknown file format", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	raws, err := parseDocuments(f, format, path)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, raw := range raws {
+		if raw.kind != IncludeKind {
+			r.docs = append(r.docs, raw)
+			continue
+		}
+		doc, err := decodeInclude(raw)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range doc.Value.(*Include).Files {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: %w", doc.Source, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("%s: no files match the include %s", doc.Source, pattern)
+			}
+			// Files listed by name must be readable, while the ones matched by a pattern are filtered by extension.
+			explicit := !strings.ContainsAny(pattern, "*?[")
+			for _, match := range matches {
+				if err := r.readPath(match, explicit); err != nil {
+					return fmt.Errorf("%s: %w", doc.Source, err)
+				}
+			}
+		}
+	}
+	return nil
+}
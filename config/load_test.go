@@ -0,0 +1,106 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "overseer-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func documentSources(docs []Document) []string {
+	res := make([]string, len(docs))
+	for i, doc := range docs {
+		res[i] = doc.Source
+	}
+	return res
+}
+
+func TestDecoder_ReadDir(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"env/20-rooms.json":      `[{"kind": "Room", "name": "garage", "color": "gray"}]`,
+		"env/10-house.yaml":      "kind: House\nid: house A\n---\nkind: Include\nfiles: [../shared/*.yaml]\n",
+		"env/30-more/room.yml":   "kind: Room\nname: attic\ncolor: white\n",
+		"env/.hidden.yaml":       "kind: Castle",
+		"env/README.md":          "Not a config",
+		"shared/bathroom.yaml":   "kind: Room\nname: bathroom\ncolor: blue\n",
+		"shared/includes.yaml":   "kind: Include\nfiles: [../env/20-rooms.json, bathroom.yaml]\n",
+		"shared/notes.txt":       "Not a config either",
+		"other/duplicate.yaml":   "kind: Room\nname: garage\ncolor: red\n",
+		"other/include-bad.yaml": "kind: Include\nfiles: [missing.yaml]\n",
+	})
+	d := testDecoder()
+
+	docs, err := d.ReadDir(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Included files are read first, even if they are in the same directory.
+	want := []string{
+		filepath.Join(dir, "env/10-house.yaml#0"),
+		filepath.Join(dir, "shared/bathroom.yaml#0"),
+		filepath.Join(dir, "env/20-rooms.json#0"),
+		filepath.Join(dir, "env/30-more/room.yml#0"),
+	}
+	if got := documentSources(docs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected documents order:\n%v\nwant\n%v", got, want)
+	}
+
+	items, err := d.LoadDir(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIds := []string{
+		"/House", "/House/house A", "/House/house A/Address", "/House/house A/Rooms",
+		"/Room", "/Room/attic", "/Room/attic/Color", "/Room/bathroom", "/Room/bathroom/Color",
+		"/Room/garage", "/Room/garage/Color",
+	}
+	if got := itemIds(items); !reflect.DeepEqual(got, wantIds) {
+		t.Errorf("Unexpected IDs: got %v, want %v", got, wantIds)
+	}
+
+	_, err = d.Load(filepath.Join(dir, "env"), filepath.Join(dir, "other/duplicate.yaml"))
+	var dupErr *DuplicateError
+	if !errors.As(err, &dupErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wantSources := []string{filepath.Join(dir, "env/20-rooms.json#0"), filepath.Join(dir, "other/duplicate.yaml#0")}
+	if dupErr.Id != "/Room/garage" || !reflect.DeepEqual(dupErr.Sources, wantSources) {
+		t.Errorf("Unexpected duplicate error: %s", dupErr)
+	}
+
+	if _, err := d.Load(filepath.Join(dir, "other/include-bad.yaml")); err == nil {
+		t.Error("Missing include is not reported")
+	}
+
+	d.Exclude = []string{filepath.Join(dir, "env/20-rooms.json"), filepath.Join(dir, "shared/bathroom.yaml")}
+	docs, err = d.ReadDir(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{filepath.Join(dir, "env/10-house.yaml#0"), filepath.Join(dir, "env/30-more/room.yml#0")}
+	if got := documentSources(docs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Excluded files are read: %v", got)
+	}
+}
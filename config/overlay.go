@@ -0,0 +1,374 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"rmazur.io/overseer/state"
+)
+
+// VariablesKind is a reserved document kind defining the variables, which can be referenced in other documents
+// as ${name}:
+//
+//	kind: Variables
+//	replicas: 3
+//	domain: staging.example.com
+//
+// A string consisting of a single reference is replaced with the variable value keeping its type,
+// otherwise the variable value is formatted into the string. Use $${ to write ${ literally.
+// Definitions from later documents take precedence.
+const VariablesKind = "Variables"
+
+// DeleteField marks overlay documents and list elements that remove the matching base ones:
+//
+//	kind: Room
+//	name: garage
+//	$delete: true
+const DeleteField = "$delete"
+
+var varReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// interpolate collects the variables and substitutes their references in the documents.
+func (d *Decoder) interpolate(raws []rawDocument) ([]rawDocument, error) {
+	vars := make(map[string]interface{})
+	res := make([]rawDocument, 0, len(raws))
+	for _, raw := range raws {
+		if raw.kind != VariablesKind {
+			res = append(res, raw)
+			continue
+		}
+		for name, value := range raw.fields {
+			vars[name] = value
+		}
+	}
+	for name, value := range d.Vars {
+		vars[name] = value
+	}
+
+	for i := range res {
+		fields, err := substitute(res[i].fields, vars)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", res[i].source, err)
+		}
+		res[i].fields = fields.(map[string]interface{})
+	}
+	return res, nil
+}
+
+func substitute(value interface{}, vars map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if res[key], err = substitute(item, vars); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if res[i], err = substitute(item, vars); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case string:
+		if m := varReference.FindStringSubmatchIndex(v); m != nil && m[0] == 0 && m[1] == len(v) && m[2] >= 0 {
+			// Keep the type of the value.
+			name := v[m[2]:m[3]]
+			if varValue, defined := vars[name]; defined {
+				return varValue, nil
+			}
+			return nil, fmt.Errorf("undefined variable %s", name)
+		}
+		var err error
+		res := varReference.ReplaceAllStringFunc(v, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+			name := ref[2 : len(ref)-1]
+			varValue, defined := vars[name]
+			if !defined && err == nil {
+				err = fmt.Errorf("undefined variable %s", name)
+			}
+			return fmt.Sprint(varValue)
+		})
+		return res, err
+	default:
+		return value, nil
+	}
+}
+
+// ReadOverlays reads the base documents and patches them with the overlays, applied in the listed order.
+// Both base and overlays can be files or directories.
+//
+// Overlay documents are matched with the base ones by kind and the `state:"id"` field of the registered type.
+// Mappings are merged recursively and a null value removes the base field.
+// Lists of structs with a `state:"id"` field are merged by ID, other values are replaced.
+// Documents and list elements with the $delete field set to true remove the matching base ones.
+// Overlay documents without a match are added to the result.
+//
+// Variables from all the documents are collected before any overlay is applied.
+func (d *Decoder) ReadOverlays(base string, overlays ...string) ([]Document, error) {
+	layers := make([][]rawDocument, len(overlays)+1)
+	var all []rawDocument
+	for i, path := range append([]string{base}, overlays...) {
+		raws, err := d.readDocuments(path)
+		if err != nil {
+			return nil, err
+		}
+		layers[i] = raws
+		all = append(all, raws...)
+	}
+	all, err := d.interpolate(all)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split the interpolated documents back into layers.
+	offset := 0
+	for i := range layers {
+		n := 0
+		for _, raw := range layers[i] {
+			if raw.kind != VariablesKind {
+				n++
+			}
+		}
+		layers[i] = all[offset : offset+n]
+		offset += n
+	}
+
+	res := layers[0]
+	for _, overlay := range layers[1:] {
+		if res, err = d.applyOverlay(res, overlay); err != nil {
+			return nil, err
+		}
+	}
+	return d.decodeDocuments(res)
+}
+
+// LoadOverlays reads the base documents, patches them with the overlays, and builds the desired state Set.
+func (d *Decoder) LoadOverlays(base string, overlays ...string) (state.Set, error) {
+	docs, err := d.ReadOverlays(base, overlays...)
+	if err != nil {
+		return nil, err
+	}
+	return BuildSet(docs)
+}
+
+func (d *Decoder) applyOverlay(base, overlay []rawDocument) ([]rawDocument, error) {
+	res := make([]rawDocument, len(base))
+	copy(res, base)
+	for _, patch := range overlay {
+		t, ok := d.kindType(patch.kind)
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown kind %q", patch.source, patch.kind)
+		}
+		patchId, keyed := documentId(t, patch.fields)
+		deleted := patch.fields[DeleteField] == true
+
+		matched := false
+		if keyed {
+			for i := 0; i < len(res); i++ {
+				doc := res[i]
+				if doc.kind != patch.kind {
+					continue
+				}
+				if docId, ok := documentId(t, doc.fields); !ok || docId != patchId {
+					continue
+				}
+				matched = true
+				if deleted {
+					res = append(res[:i], res[i+1:]...)
+					i--
+				} else {
+					res[i].fields = mergeValue(doc.fields, patch.fields, t).(map[string]interface{})
+				}
+			}
+		}
+		if !matched && !deleted {
+			patch.fields = mergeValue(map[string]interface{}{}, patch.fields, t).(map[string]interface{})
+			res = append(res, patch)
+		}
+	}
+	return res, nil
+}
+
+// documentId returns the ID of the document or list element fields decoded into the struct type t, derived with
+// state.StructId the same way BuildStateItems does it. The fields are not identified if any of the `state:"id"`
+// fields is missing, or if they cannot be decoded.
+func documentId(t reflect.Type, fields map[string]interface{}) (string, bool) {
+	if t.Kind() != reflect.Struct {
+		return "", false
+	}
+	idFields := state.IdFields(t)
+	if len(idFields) == 0 && state.IdMethod(t) == "" {
+		return "", false
+	}
+	for _, index := range idFields {
+		name, _ := jsonName(t.Field(index))
+		if fields[name] == nil {
+			return "", false
+		}
+	}
+
+	values := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if key != DeleteField {
+			values[key] = value
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", false
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return "", false
+	}
+	return state.StructId(v.Interface())
+}
+
+// mergeValue patches the base value, using t to find how lists should be merged.
+// The type t may be nil if it is unknown.
+func mergeValue(base, patch interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return patch
+		}
+		res := make(map[string]interface{}, len(b)+len(p))
+		for key, value := range b {
+			res[key] = value
+		}
+		for key, value := range p {
+			if key == DeleteField {
+				continue
+			}
+			if value == nil {
+				delete(res, key)
+			} else {
+				res[key] = mergeValue(b[key], value, fieldType(t, key))
+			}
+		}
+		return res
+
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || t == nil || (t.Kind() != reflect.Slice && t.Kind() != reflect.Array) {
+			return patch
+		}
+		elemType := t.Elem()
+		for elemType.Kind() == reflect.Ptr {
+			elemType = elemType.Elem()
+		}
+		if elemType.Kind() != reflect.Struct || (len(state.IdFields(elemType)) == 0 && state.IdMethod(elemType) == "") {
+			return patch
+		}
+
+		res := make([]interface{}, len(b))
+		copy(res, b)
+		for _, item := range p {
+			patchItem, ok := item.(map[string]interface{})
+			if !ok {
+				return patch
+			}
+			deleted := patchItem[DeleteField] == true
+			patchId, keyed := documentId(elemType, patchItem)
+			matched := false
+			for i := 0; keyed && i < len(res); i++ {
+				baseItem, ok := res[i].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if baseId, ok := documentId(elemType, baseItem); !ok || baseId != patchId {
+					continue
+				}
+				matched = true
+				if deleted {
+					res = append(res[:i], res[i+1:]...)
+					i--
+				} else {
+					res[i] = mergeValue(baseItem, patchItem, elemType)
+				}
+			}
+			if !matched && !deleted {
+				res = append(res, mergeValue(map[string]interface{}{}, patchItem, elemType))
+			}
+		}
+		return res
+
+	default:
+		return patch
+	}
+}
+
+// fieldType returns the type of the value stored under the key in a decoded value of type t.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		if f, ok := jsonField(t, key); ok {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+// jsonField finds the struct field encoding/json would decode the key into.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var embedded []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, tagged := jsonName(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && !tagged {
+			embedded = append(embedded, f)
+			continue
+		}
+		if f.PkgPath == "" && strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			if res, ok := jsonField(ft, key); ok {
+				return res, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonName returns the name of the field in JSON documents and whether it is set with a tag.
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if comma := strings.IndexByte(tag, ','); comma >= 0 {
+		tag = tag[:comma]
+	}
+	if tag == "" {
+		return f.Name, false
+	}
+	return tag, true
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder_ReadOverlays(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base/vars.yaml": "kind: Variables\ncity: Kyiv\nwall: white\n",
+		"base/house.yaml": `
+kind: House
+id: house A
+address: 5 Cherry lane, ${city}
+note: $${not a variable}
+rooms:
+  - name: kitchen
+    color: ${wall}
+  - name: garage
+    color: gray
+  - name: attic
+    color: ${wall}
+`,
+		"base/garage.yaml": "kind: Room\nname: garage\ncolor: gray\n",
+		"staging/patch.yaml": `
+kind: Variables
+wall: beige
+---
+kind: House
+id: house A
+note: null
+rooms:
+  - name: garage
+    $delete: true
+  - name: attic
+    color: blue
+  - name: bedroom
+    color: ${wall}
+---
+kind: Room
+name: garage
+$delete: true
+---
+kind: Room
+name: shed
+color: green
+`,
+		"prod/patch.json": `{"kind": "House", "id": "house A", "address": "1 Main st, ${city}"}`,
+	})
+	d := testDecoder()
+	d.Vars = map[string]interface{}{"city": "Lviv"}
+
+	docs, err := d.ReadOverlays(filepath.Join(dir, "base"), filepath.Join(dir, "staging"), filepath.Join(dir, "prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Unexpected documents: %v", docs)
+	}
+
+	wantHouse := &testHouse{
+		Id:      "house A",
+		Address: "1 Main st, Lviv",
+		Rooms: []*testRoom{
+			{Name: "kitchen", Color: "beige"},
+			{Name: "attic", Color: "blue"},
+			{Name: "bedroom", Color: "beige"},
+		},
+	}
+	if !reflect.DeepEqual(docs[0].Value, wantHouse) {
+		t.Errorf("Unexpected house: %#v", docs[0].Value)
+	}
+	if !reflect.DeepEqual(docs[1].Value, &testRoom{Name: "shed", Color: "green"}) {
+		t.Errorf("Unexpected room: %#v", docs[1].Value)
+	}
+
+	// Without overlays.
+	docs, err = d.ReadOverlays(filepath.Join(dir, "base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if house := docs[1].Value.(*testHouse); house.Note != "${not a variable}" || house.Rooms[0].Color != "white" {
+		t.Errorf("Unexpected house: %#v", house)
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	vars := map[string]interface{}{"n": 3, "s": "x"}
+	got, err := substitute(map[string]interface{}{
+		"typed":  "${n}",
+		"format": "${s}-${n}",
+		"list":   []interface{}{"${s}", 5},
+	}, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"typed": 3, "format": "x-3", "list": []interface{}{"x", 5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result: got %v, want %v", got, want)
+	}
+
+	if _, err := substitute("a ${missing}", vars); err == nil {
+		t.Error("Undefined variable is not reported")
+	}
+}
+
+type testServer struct {
+	Region string           `json:"region" state:"id"`
+	Name   string           `json:"name" state:"id"`
+	Size   int              `json:"size"`
+	Ports  []testPortMethod `json:"ports"`
+}
+
+type testPortMethod struct {
+	Proto  string `json:"proto"`
+	Number int    `json:"number"`
+	Open   bool   `json:"open"`
+}
+
+func (p testPortMethod) StateId() string {
+	return fmt.Sprintf("%s-%d", p.Proto, p.Number)
+}
+
+func TestDecoder_ReadOverlays_Ids(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"base/servers.yaml": `
+kind: Server
+region: eu
+name: web
+size: 1
+ports:
+  - {proto: tcp, number: 80, open: true}
+  - {proto: udp, number: 80, open: true}
+---
+kind: Server
+region: us
+name: web
+size: 1
+`,
+		"patch/servers.yaml": `
+kind: Server
+region: eu
+name: web
+size: 2
+ports:
+  - {proto: udp, number: 80, open: false}
+  - {proto: tcp, number: 443, open: true}
+---
+kind: Server
+region: us
+name: web
+$delete: true
+`,
+	})
+	d := NewDecoder()
+	d.Register("Server", &testServer{})
+
+	docs, err := d.ReadOverlays(filepath.Join(dir, "base"), filepath.Join(dir, "patch"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &testServer{
+		Region: "eu", Name: "web", Size: 2,
+		Ports: []testPortMethod{
+			{Proto: "tcp", Number: 80, Open: true},
+			{Proto: "udp", Number: 80, Open: false},
+			{Proto: "tcp", Number: 443, Open: true},
+		},
+	}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Value, want) {
+		t.Errorf("Unexpected documents: %#v", docs)
+	}
+	if _, err := BuildSet(docs); err != nil {
+		t.Error(err)
+	}
+}
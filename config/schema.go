@@ -0,0 +1,116 @@
+package config
+
+import (
+	"strings"
+
+	"rmazur.io/overseer/state"
+)
+
+// JSONSchema generates the schema of the configuration files with the documents of the registered kinds,
+// so that editors can complete and check them.
+// A file is either a single document or a list of documents. Values referencing variables with ${name} are
+// checked as they are written, so such references are only valid in the string fields.
+// The schema also describes the overlays: the documents and the identified list elements may have the
+// $delete field.
+func (d *Decoder) JSONSchema() (*state.Schema, error) {
+	definitions := make(map[string]*state.Schema)
+	var kinds []*state.Schema
+	for _, name := range d.registry.Names() {
+		if name == IncludeKind || name == VariablesKind {
+			continue
+		}
+		rt, _ := d.registry.Lookup(name)
+		s, err := rt.JSONSchema()
+		if err != nil {
+			return nil, err
+		}
+		for defName, def := range s.Definitions {
+			definitions[defName] = def
+		}
+		s.Schema, s.Definitions = "", nil
+
+		// The properties may be shared with a definition of a recursive type.
+		properties := map[string]*state.Schema{KindField: {Const: name}, DeleteField: deleteSchema()}
+		for propName, prop := range s.Properties {
+			properties[propName] = prop
+		}
+		s.Properties = properties
+		s.Required = append([]string{KindField}, s.Required...)
+		kinds = append(kinds, s)
+	}
+	seen := make(map[*state.Schema]bool)
+	for _, kind := range kinds {
+		allowDelete(kind, definitions, seen)
+	}
+
+	kinds = append(kinds,
+		&state.Schema{
+			Title:       IncludeKind,
+			Description: "Files read together with the including one, relative to its directory, may be glob patterns.",
+			Type:        "object",
+			Properties: map[string]*state.Schema{
+				KindField: {Const: IncludeKind},
+				"files":   {Type: "array", Items: &state.Schema{Type: "string"}},
+			},
+			Required:             []string{KindField, "files"},
+			AdditionalProperties: false,
+		},
+		&state.Schema{
+			Title:       VariablesKind,
+			Description: "Values substituted for the ${name} references in the documents.",
+			Type:        "object",
+			Properties:  map[string]*state.Schema{KindField: {Const: VariablesKind}},
+			Required:    []string{KindField},
+		},
+	)
+	definitions["document"] = &state.Schema{OneOf: kinds}
+
+	document := &state.Schema{Ref: "#/definitions/document"}
+	return &state.Schema{
+		Schema:      state.SchemaDraft,
+		OneOf:       []*state.Schema{document, {Type: "array", Items: document}},
+		Definitions: definitions,
+	}, nil
+}
+
+func deleteSchema() *state.Schema {
+	return &state.Schema{Type: "boolean", Description: "Removes the matching base value when set in an overlay."}
+}
+
+// allowDelete adds the DeleteField property to the identified list elements nested in the schema,
+// as overlays may remove them.
+func allowDelete(s *state.Schema, definitions map[string]*state.Schema, seen map[*state.Schema]bool) {
+	if s == nil || seen[s] {
+		return
+	}
+	seen[s] = true
+	if s.Ref != "" {
+		allowDelete(definitions[refName(s.Ref)], definitions, seen)
+		return
+	}
+	if s.Items != nil {
+		items := s.Items
+		if items.Ref != "" {
+			items = definitions[refName(items.Ref)]
+		}
+		if items != nil && (items.StateId != "" || items.StateIdMethod != "") {
+			items.Properties[DeleteField] = deleteSchema()
+		}
+	}
+	allowDelete(s.Items, definitions, seen)
+	for _, prop := range s.Properties {
+		allowDelete(prop, definitions, seen)
+	}
+	if values, ok := s.AdditionalProperties.(*state.Schema); ok {
+		allowDelete(values, definitions, seen)
+	}
+}
+
+// refName returns the definition key of the local schema reference.
+func refName(ref string) string {
+	path, err := state.ParsePath(strings.TrimPrefix(ref, "#/definitions"))
+	if err != nil || len(path) != 1 {
+		return ""
+	}
+	return path[0]
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecoder_JSONSchema(t *testing.T) {
+	s, err := testDecoder().JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := s.Definitions["document"]
+	if document == nil || len(s.OneOf) != 2 || s.OneOf[1].Items.Ref != "#/definitions/document" {
+		t.Fatalf("Unexpected schema: %+v", s)
+	}
+
+	var titles []string
+	for _, kind := range document.OneOf {
+		titles = append(titles, kind.Title)
+		if kind.Properties[KindField].Const != kind.Title || kind.Required[0] != KindField {
+			t.Errorf("Kind field is not defined for %s: %+v", kind.Title, kind)
+		}
+	}
+	if want := []string{"House", "Room", IncludeKind, VariablesKind}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("Unexpected kinds: got %v, want %v", titles, want)
+	}
+
+	house := document.OneOf[0]
+	if house.StateId != "id" || house.Properties["rooms"].Items.StateId != "name" {
+		t.Errorf("Unexpected house schema: %+v", house)
+	}
+	if _, present := house.Properties["note"]; present {
+		t.Error("Field excluded from the state is in the schema")
+	}
+	if house.Properties[DeleteField] == nil || house.Properties["rooms"].Items.Properties[DeleteField] == nil {
+		t.Errorf("Overlay deletions are not allowed: %+v", house)
+	}
+}
@@ -1,3 +1,5 @@
-module "rmazur.io/overseer"
+module rmazur.io/overseer
 
 go 1.14
+
+require gopkg.in/yaml.v3 v3.0.1
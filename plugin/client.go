@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+
+	"rmazur.io/overseer/state"
+)
+
+// Client is the host side of the connection to a plugin.
+type Client struct {
+	name string
+	rpc  *rpc.Client
+	cmd  *exec.Cmd
+}
+
+// Start runs the plugin executable and connects to it with its standard input and output.
+// The plugin standard error is forwarded to the host one.
+func Start(path string, args ...string) (*Client, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start plugin %s: %w", path, err)
+	}
+	c := NewClient(path, pipe{ReadCloser: stdout, WriteCloser: stdin})
+	c.cmd = cmd
+	return c, nil
+}
+
+// NewClient returns a client talking to a plugin over the connection. The name is used in errors.
+func NewClient(name string, conn io.ReadWriteCloser) *Client {
+	return &Client{name: name, rpc: jsonrpc.NewClient(conn)}
+}
+
+// Close closes the connection and waits for the plugin process to exit, if it was started with Start.
+func (c *Client) Close() error {
+	err := c.rpc.Close()
+	if c.cmd != nil {
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			return fmt.Errorf("plugin %s: %w", c.name, waitErr)
+		}
+	}
+	return err
+}
+
+func (c *Client) call(ctx context.Context, method string, req *Request, resp *Response) error {
+	call := c.rpc.Go(ServiceName+"."+method, req, resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return fmt.Errorf("plugin %s: %s %s: %w", c.name, method, req.Id, call.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Item returns the item with the given ID forwarding its actions to the plugin.
+// The value is sent to the plugin encoded as JSON.
+func (c *Client) Item(kind, id string, value interface{}) (*Item, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s value %s: %w", kind, id, err)
+	}
+	return &Item{Kind: kind, IdValue: id, Value: data, client: c}, nil
+}
+
+// Observe reads the actual state of the resource identified by the value.
+// It returns a nil value if the resource does not exist.
+func (c *Client) Observe(ctx context.Context, kind, id string, value interface{}) (*Item, error) {
+	item, err := c.Item(kind, id, value)
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := c.call(ctx, "Observe", item.request(), &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Exists {
+		return nil, nil
+	}
+	return c.Item(kind, id, resp.Value)
+}
+
+// Item is the state item implemented by a plugin.
+type Item struct {
+	Kind    string
+	IdValue string
+	Value   json.RawMessage
+
+	client *Client
+}
+
+func (pi *Item) request() *Request {
+	return &Request{Kind: pi.Kind, Id: pi.IdValue, Value: pi.Value}
+}
+
+func (pi *Item) Id() string {
+	return pi.IdValue
+}
+
+func (pi *Item) String() string {
+	return fmt.Sprintf("%s %s", pi.Kind, pi.Value)
+}
+
+func (pi *Item) IsSame(item state.Item) bool {
+	other, ok := item.(*Item)
+	return ok && other.Kind == pi.Kind && other.IdValue == pi.IdValue && bytes.Equal(other.Value, pi.Value)
+}
+
+// ContentHash implements state.Hasher so that the connection does not affect the item hash.
+func (pi *Item) ContentHash() []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", pi.Kind, pi.IdValue)
+	h.Write(pi.Value)
+	return h.Sum(nil)
+}
+
+func (pi *Item) Create(ctx context.Context) error {
+	return pi.client.call(ctx, "Create", pi.request(), new(Response))
+}
+
+func (pi *Item) Remove(ctx context.Context) error {
+	return pi.client.call(ctx, "Remove", pi.request(), new(Response))
+}
+
+// Update sends the previous value to the plugin. The from value is either a plugin item or a value encoded as JSON.
+func (pi *Item) Update(ctx context.Context, from interface{}) error {
+	req := pi.request()
+	if prev, ok := from.(*Item); ok {
+		req.Prev = prev.Value
+	} else {
+		data, err := json.Marshal(from)
+		if err != nil {
+			return fmt.Errorf("bad previous %s value %s: %w", pi.Kind, pi.IdValue, err)
+		}
+		req.Prev = data
+	}
+	return pi.client.call(ctx, "Update", req, new(Response))
+}
+
+// pipe joins the plugin standard output and input.
+type pipe struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (p pipe) Close() error {
+	werr := p.WriteCloser.Close()
+	rerr := p.ReadCloser.Close()
+	if werr != nil {
+		return werr
+	}
+	return rerr
+}
@@ -0,0 +1,47 @@
+// Package plugin runs resource implementations in separate executables.
+//
+// A plugin is an executable that reads JSON-RPC 1.0 requests from its standard input and writes the responses
+// to its standard output. It must handle the following methods, each taking a single Request parameter:
+//
+//	Provider.Create   create the resource described by the value
+//	Provider.Remove   remove the resource described by the value
+//	Provider.Update   move the resource from the prev value to the value
+//	Provider.Observe  read the actual state of the resource identified by the value
+//
+// Create, Remove and Update reply with an empty Response. Observe fills the Response with the actual value of
+// the resource, if it exists. Errors are reported with the error field of the JSON-RPC response.
+// A plugin should exit when its standard input is closed.
+//
+// For example, a request creating a file and its response look like
+//
+//	{"method": "Provider.Create", "params": [{"kind": "File", "id": "/a.txt", "value": {"path": "/a.txt"}}], "id": 0}
+//	{"id": 0, "result": {}, "error": null}
+//
+// The host side uses Client to start a plugin and to build the Items forwarding their actions to it.
+// Plugins written in Go can use Serve to expose the resource types from a state.Registry.
+package plugin // import rmazur.io/overseer/plugin
+
+import "encoding/json"
+
+// ServiceName is the prefix of the protocol method names.
+const ServiceName = "Provider"
+
+// Request is the parameter of all the protocol methods.
+type Request struct {
+	// Kind is the name of the resource type.
+	Kind string `json:"kind"`
+	// Id is the item ID the host uses for the resource.
+	Id string `json:"id"`
+	// Value describes the desired state of the resource.
+	Value json.RawMessage `json:"value"`
+	// Prev is the previous value of the resource, it is only set for Update.
+	Prev json.RawMessage `json:"prev,omitempty"`
+}
+
+// Response is the result of the protocol methods.
+type Response struct {
+	// Exists reports whether the observed resource exists.
+	Exists bool `json:"exists,omitempty"`
+	// Value is the observed value of the resource.
+	Value json.RawMessage `json:"value,omitempty"`
+}
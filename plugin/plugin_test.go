@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"rmazur.io/overseer/state"
+)
+
+// testStore is the external system managed by the test plugin.
+type testStore struct {
+	mu     sync.Mutex
+	values map[string]string
+	log    []string
+}
+
+var store = &testStore{values: make(map[string]string)}
+
+func (ts *testStore) record(format string, args ...interface{}) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.log = append(ts.log, fmt.Sprintf(format, args...))
+}
+
+func (ts *testStore) actions() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.log...)
+}
+
+func (ts *testStore) resetLog() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.log = nil
+}
+
+func (ts *testStore) set(name, value string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.values[name] = value
+}
+
+func (ts *testStore) get(name string) (string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	value, exists := ts.values[name]
+	return value, exists
+}
+
+func (ts *testStore) remove(name string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.values, name)
+}
+
+type testKey struct {
+	Name  string `json:"name" state:"id"`
+	Value string `json:"value" state:"Set"`
+}
+
+func (tk *testKey) Create(ctx context.Context) error {
+	if tk.Name == "bad" {
+		return fmt.Errorf("bad key")
+	}
+	store.record("create %s=%s", tk.Name, tk.Value)
+	store.set(tk.Name, tk.Value)
+	return nil
+}
+
+func (tk *testKey) Remove(ctx context.Context) error {
+	store.record("remove %s", tk.Name)
+	store.remove(tk.Name)
+	return nil
+}
+
+func (tk *testKey) Set(ctx context.Context, prev string) error {
+	store.record("set %s from %s to %s", tk.Name, prev, tk.Value)
+	store.set(tk.Name, tk.Value)
+	return nil
+}
+
+func (tk *testKey) Observe(ctx context.Context) (bool, error) {
+	value, exists := store.get(tk.Name)
+	tk.Value = value
+	return exists, nil
+}
+
+func testRegistry() *state.Registry {
+	r := state.NewRegistry()
+	if err := r.Register("Key", &testKey{}, state.Metadata{}); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// TestMain runs the test binary as a plugin when it is started by TestStart.
+func TestMain(m *testing.M) {
+	if os.Getenv("OVERSEER_TEST_PLUGIN") == "1" {
+		Serve(testRegistry())
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestStart(t *testing.T) {
+	os.Setenv("OVERSEER_TEST_PLUGIN", "1")
+	c, err := Start(os.Args[0])
+	os.Unsetenv("OVERSEER_TEST_PLUGIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Observe(context.Background(), "Key", "/missing", &testKey{Name: "missing"})
+	if err != nil || item != nil {
+		t.Errorf("Unexpected result of observing a missing item: %v, %v", item, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Plugin did not exit cleanly: %v", err)
+	}
+}
+
+// startTestPlugin serves the plugin in-process over a pipe.
+func startTestPlugin(t *testing.T) *Client {
+	hostConn, pluginConn := net.Pipe()
+	go ServeConn(testRegistry(), pluginConn)
+	c := NewClient("test", hostConn)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+func mustItem(t *testing.T, c *Client, kind, id string, value interface{}) state.Item {
+	item, err := c.Item(kind, id, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestClient(t *testing.T) {
+	c := startTestPlugin(t)
+	ctx := context.Background()
+	store.resetLog()
+
+	prev := state.Set{
+		mustItem(t, c, "Key", "/a", &testKey{Name: "a", Value: "1"}),
+		mustItem(t, c, "Key", "/b", map[string]string{"name": "b", "value": "2"}),
+	}
+	if err := state.InferActions(nil, prev).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	next := state.Set{
+		mustItem(t, c, "Key", "/a", &testKey{Name: "a", Value: "1"}),
+		mustItem(t, c, "Key", "/b", &testKey{Name: "b", Value: "3"}),
+	}
+	if !prev[0].IsSame(next[0]) || state.Hash(prev[0]) != state.Hash(next[0]) {
+		t.Error("Same values are not the same")
+	}
+	if err := state.InferActions(prev, next).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.InferActions(next, nil).Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"create a=1", "create b=2",
+		"set b from 2 to 3",
+		"remove a", "remove b",
+	}
+	if got := store.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected plugin actions: got %v, want %v", got, want)
+	}
+}
+
+func TestClient_Observe(t *testing.T) {
+	c := startTestPlugin(t)
+	ctx := context.Background()
+	store.set("x", "42")
+	defer store.remove("x")
+
+	item, err := c.Observe(ctx, "Key", "/x", &testKey{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item == nil || string(item.Value) != `{"name":"x","value":"42"}` {
+		t.Errorf("Unexpected observed item: %v", item)
+	}
+	if !item.IsSame(mustItem(t, c, "Key", "/x", &testKey{Name: "x", Value: "42"})) {
+		t.Error("Observed item is not the same as the desired one")
+	}
+
+	item, err = c.Observe(ctx, "Key", "/y", &testKey{Name: "y"})
+	if err != nil || item != nil {
+		t.Errorf("Unexpected result of observing a missing item: %v, %v", item, err)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	c := startTestPlugin(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		item    state.Item
+		wantErr string
+	}{
+		{name: "action error", item: mustItem(t, c, "Key", "/bad", &testKey{Name: "bad"}), wantErr: "plugin test: Create /bad: bad key"},
+		{name: "unknown kind", item: mustItem(t, c, "Lock", "/l", &testKey{}), wantErr: `unknown kind "Lock"`},
+		{name: "bad value", item: mustItem(t, c, "Key", "/k", []int{1}), wantErr: "bad Key value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.item.Create(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	// The host survives the plugin going away.
+	_ = c.Close()
+	if err := mustItem(t, c, "Key", "/a", &testKey{Name: "a"}).Create(ctx); err == nil {
+		t.Error("No error after the plugin connection is closed")
+	}
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+
+	"rmazur.io/overseer/state"
+)
+
+// Observer is implemented by the resource types able to read their actual state.
+// Observe is called on a value decoded from the request, it should fill the value with the actual state and
+// report whether the resource exists.
+type Observer interface {
+	Observe(ctx context.Context) (bool, error)
+}
+
+// Serve exposes the resource types of the registry to the host over the standard input and output.
+// It returns when the host closes the connection.
+func Serve(r *state.Registry) {
+	ServeConn(r, pipe{ReadCloser: os.Stdin, WriteCloser: os.Stdout})
+}
+
+// ServeConn exposes the resource types of the registry over the connection.
+// The values are decoded into the registered types, and their actions are inferred with BuildStateItems, so
+// that the field update methods are called the same way as for the resources implemented by the host.
+func ServeConn(r *state.Registry, conn io.ReadWriteCloser) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(ServiceName, &service{registry: r}); err != nil {
+		panic(err)
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+type service struct {
+	registry *state.Registry
+}
+
+func (s *service) decode(kind string, data json.RawMessage) (interface{}, error) {
+	rt, ok := s.registry.Lookup(kind)
+	if !ok {
+		return nil, fmt.Errorf("unknown kind %q", kind)
+	}
+	value := rt.New()
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, fmt.Errorf("bad %s value: %w", kind, err)
+	}
+	return value, nil
+}
+
+func (s *service) build(kind string, data json.RawMessage) (state.Set, error) {
+	value, err := s.decode(kind, data)
+	if err != nil {
+		return nil, err
+	}
+	return state.BuildStateItems(value)
+}
+
+func (s *service) Create(req *Request, resp *Response) error {
+	items, err := s.build(req.Kind, req.Value)
+	if err != nil {
+		return err
+	}
+	return state.InferActions(nil, items).Do(context.Background())
+}
+
+func (s *service) Remove(req *Request, resp *Response) error {
+	items, err := s.build(req.Kind, req.Value)
+	if err != nil {
+		return err
+	}
+	return state.InferActions(items, nil).Do(context.Background())
+}
+
+func (s *service) Update(req *Request, resp *Response) error {
+	prev, err := s.build(req.Kind, req.Prev)
+	if err != nil {
+		return err
+	}
+	next, err := s.build(req.Kind, req.Value)
+	if err != nil {
+		return err
+	}
+	return state.InferActions(prev, next).Do(context.Background())
+}
+
+func (s *service) Observe(req *Request, resp *Response) error {
+	value, err := s.decode(req.Kind, req.Value)
+	if err != nil {
+		return err
+	}
+	observer, ok := value.(Observer)
+	if !ok {
+		return fmt.Errorf("%s cannot be observed", req.Kind)
+	}
+	exists, err := observer.Observe(context.Background())
+	if err != nil || !exists {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp.Exists, resp.Value = true, data
+	return nil
+}
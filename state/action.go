@@ -38,6 +38,9 @@ type actions struct {
 
 	create, remove       ActionFunc
 	update, parentUpdate updateActionFunc
+
+	// Name of the parent method bound to parentUpdate.
+	parentUpdateName string
 }
 
 func callAction(a ActionFunc, ctx context.Context) error {
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotApproved is returned by Executor.Apply when the plan is rejected by the Approver.
+var ErrNotApproved = errors.New("plan is not approved")
+
+// Approver confirms that the plan may be performed.
+type Approver interface {
+	Approve(ctx context.Context, p *Plan) (bool, error)
+}
+
+// ApproverFunc is an Approver implemented with a single function.
+type ApproverFunc func(ctx context.Context, p *Plan) (bool, error)
+
+func (af ApproverFunc) Approve(ctx context.Context, p *Plan) (bool, error) {
+	return af(ctx, p)
+}
+
+// TerminalApprover prints the plan and asks the user for a confirmation.
+// The approver may be asked several times, the answers are read from In one line at a time.
+type TerminalApprover struct {
+	// In provides the answers. It is not read if the plan is approved without asking.
+	In io.Reader
+	// Out is required, the plan and the question are printed to it.
+	Out io.Writer
+
+	// AutoApprove makes the approver accept any plan without asking.
+	AutoApprove bool
+	// PlanDigest pre-approves the plan with the given digest without asking, see Plan.Digest.
+	// Any other plan is rejected.
+	PlanDigest string
+
+	// reader buffers In, so that the input following the answer is not lost between the questions.
+	reader *bufio.Reader
+	// readerIn is the In the reader is created for.
+	readerIn io.Reader
+}
+
+func (ta *TerminalApprover) Approve(ctx context.Context, p *Plan) (bool, error) {
+	if ta.Out == nil {
+		return false, errors.New("terminal approver has no output")
+	}
+	if _, err := fmt.Fprint(ta.Out, p.String()); err != nil {
+		return false, err
+	}
+
+	if ta.AutoApprove {
+		return true, nil
+	}
+	if ta.PlanDigest != "" {
+		if digest := p.Digest(); digest != ta.PlanDigest {
+			_, err := fmt.Fprintf(ta.Out, "\nPlan digest %s does not match the approved one %s.\n", digest, ta.PlanDigest)
+			return false, err
+		}
+		return true, nil
+	}
+
+	if _, err := fmt.Fprint(ta.Out, "\nDo you want to perform these actions?\n"+
+		"  Only 'yes' will be accepted to approve.\n\n"+
+		"  Enter a value: "); err != nil {
+		return false, err
+	}
+	if ta.In == nil {
+		return false, errors.New("terminal approver has no input")
+	}
+	if ta.reader == nil || ta.readerIn != ta.In {
+		ta.reader, ta.readerIn = bufio.NewReader(ta.In), ta.In
+	}
+	answer, err := ta.reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.TrimSpace(answer) == "yes", nil
+}
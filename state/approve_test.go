@@ -0,0 +1,140 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func approvalTestPlan(t *testing.T, recording *recorder) *Plan {
+	prev, err := BuildStateItems(makeTestStruct(recording))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := makeTestStruct(recording)
+	value.Value = "v2"
+	value.AnotherValue = 12
+	next, err := BuildStateItems(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPlan(prev, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPlan_String(t *testing.T) {
+	p := approvalTestPlan(t, nil)
+	want := "  ~ /aa\n" +
+		"  ~ /aa/Value (Reset): v1 -> v2\n" +
+		"  ~ /aa/AnotherValue: 11 -> 12\n" +
+		"Plan: 0 to create, 3 to update, 0 to remove.\n"
+	if got := p.String(); got != want {
+		t.Errorf("Unexpected plan rendering:\n%s\nwant\n%s", got, want)
+	}
+	if p.Digest() != approvalTestPlan(t, nil).Digest() {
+		t.Error("Digest is not stable")
+	}
+}
+
+func TestPlan_Digest(t *testing.T) {
+	var r recorder
+	plan := func(before, after string) *Plan {
+		p, err := NewPlan(
+			Set{&StringItem{Actionable: testStateItem{id: "a", recorder: &r}, IdValue: "a", Value: before}},
+			Set{&StringItem{Actionable: testStateItem{id: "a", recorder: &r}, IdValue: "a", Value: after}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	p, other := plan("1", "2"), plan("1", "rm -rf")
+	if p.String() != other.String() {
+		t.Fatalf("Values are rendered:\n%s", p)
+	}
+	if p.Digest() == other.Digest() {
+		t.Error("Plans with different values have the same digest")
+	}
+	if p.Digest() != plan("1", "2").Digest() {
+		t.Error("Digest is not stable")
+	}
+}
+
+func TestTerminalApprover(t *testing.T) {
+	p := approvalTestPlan(t, nil)
+
+	tests := []struct {
+		name     string
+		approver TerminalApprover
+		want     bool
+	}{
+		{name: "yes", approver: TerminalApprover{In: strings.NewReader("yes\n")}, want: true},
+		{name: "no", approver: TerminalApprover{In: strings.NewReader("no\n")}, want: false},
+		{name: "no input", approver: TerminalApprover{In: strings.NewReader("")}, want: false},
+		{name: "auto", approver: TerminalApprover{AutoApprove: true}, want: true},
+		{name: "digest", approver: TerminalApprover{PlanDigest: p.Digest()}, want: true},
+		{name: "stale digest", approver: TerminalApprover{PlanDigest: "abc"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tt.approver.Out = &out
+			got, err := tt.approver.Approve(context.TODO(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Unexpected approval result %t", got)
+			}
+			if !strings.HasPrefix(out.String(), p.String()) {
+				t.Errorf("Plan is not printed, got %s", out.String())
+			}
+		})
+	}
+}
+
+func TestTerminalApprover_Repeated(t *testing.T) {
+	p := approvalTestPlan(t, nil)
+	ta := &TerminalApprover{In: strings.NewReader("no\nyes\n"), Out: &bytes.Buffer{}}
+	for _, want := range []bool{false, true} {
+		got, err := ta.Approve(context.TODO(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Unexpected approval result %t", got)
+		}
+	}
+
+	if _, err := (&TerminalApprover{AutoApprove: true}).Approve(context.TODO(), p); err == nil {
+		t.Error("No error without output")
+	}
+	if _, err := (&TerminalApprover{Out: &bytes.Buffer{}}).Approve(context.TODO(), p); err == nil {
+		t.Error("No error without input")
+	}
+}
+
+func TestExecutor_Approver(t *testing.T) {
+	var recording recorder
+	p := approvalTestPlan(t, &recording)
+
+	e := &Executor{Approver: &TerminalApprover{In: strings.NewReader("no\n"), Out: &bytes.Buffer{}}}
+	if err := e.Apply(context.TODO(), p); err != ErrNotApproved {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(recording) != 0 {
+		t.Errorf("Rejected plan was performed: %s", recording)
+	}
+
+	e.Approver = &TerminalApprover{In: strings.NewReader("yes\n"), Out: &bytes.Buffer{}}
+	if err := e.Apply(context.TODO(), p); err != nil {
+		t.Fatal(err)
+	}
+	if len(recording) != 1 {
+		t.Errorf("Unexpected actions result: %s", recording)
+	}
+}
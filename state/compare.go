@@ -0,0 +1,144 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// comparator tells whether two values of the same type are equal.
+type comparator func(a, b reflect.Value) bool
+
+var comparators = struct {
+	sync.RWMutex
+	byType map[reflect.Type]reflect.Value
+	byName map[string]reflect.Value
+}{
+	byType: make(map[reflect.Type]reflect.Value),
+	byName: make(map[string]reflect.Value),
+}
+
+// RegisterComparator registers fn, a func(a, b T) bool, to compare the values of type T instead of
+// reflect.DeepEqual. It panics if fn is not such a function.
+//
+// Values with a comparator are not split into the nested parts by BuildStateItems, they are compared as a whole.
+// Types with an Equal(other T) bool method are compared with it if they do not have a registered comparator.
+func RegisterComparator(fn interface{}) {
+	f, t, err := comparatorFunc(fn)
+	if err != nil {
+		panic(fmt.Errorf("state: cannot register comparator: %w", err))
+	}
+	comparators.Lock()
+	defer comparators.Unlock()
+	comparators.byType[t] = f
+}
+
+// RegisterNamedComparator registers fn, a func(a, b T) bool, to compare the values of the fields tagged with
+// `state:"cmp=name"`. It panics if fn is not such a function.
+// The field comparator takes precedence over the comparator of the field type. The comparator of a slice, array,
+// or map field compares the elements if it does not accept the field type.
+func RegisterNamedComparator(name string, fn interface{}) {
+	f, _, err := comparatorFunc(fn)
+	if err != nil {
+		panic(fmt.Errorf("state: cannot register comparator %s: %w", name, err))
+	}
+	comparators.Lock()
+	defer comparators.Unlock()
+	comparators.byName[name] = f
+}
+
+func comparatorFunc(fn interface{}) (reflect.Value, reflect.Type, error) {
+	f := reflect.ValueOf(fn)
+	if f.Kind() != reflect.Func || f.IsNil() {
+		return f, nil, fmt.Errorf("%T is not a function", fn)
+	}
+	t := f.Type()
+	if t.NumIn() != 2 || t.In(0) != t.In(1) || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Bool {
+		return f, nil, fmt.Errorf("bad comparator signature %s, expected func(a, b T) bool", t)
+	}
+	return f, t.In(0), nil
+}
+
+// comparatorOf returns the comparator of v: the one registered with the name set in the field tag, the one
+// registered for the type, or the Equal method. It returns nil if the values are compared with reflect.DeepEqual.
+func comparatorOf(v reflect.Value, name string) (comparator, error) {
+	comparators.RLock()
+	defer comparators.RUnlock()
+
+	if name != "" {
+		f, present := comparators.byName[name]
+		if !present {
+			return nil, fmt.Errorf("unknown comparator %q", name)
+		}
+		if argType := f.Type().In(0); !v.Type().AssignableTo(argType) {
+			return nil, fmt.Errorf("comparator %q of %s cannot compare %s", name, argType, v.Type())
+		}
+		return funcComparator(f), nil
+	}
+	if f, present := comparators.byType[v.Type()]; present {
+		return funcComparator(f), nil
+	}
+	return equalMethod(v.Type()), nil
+}
+
+// namedComparatorAccepts tells whether the comparator registered with the name compares the values of type t.
+func namedComparatorAccepts(name string, t reflect.Type) bool {
+	comparators.RLock()
+	defer comparators.RUnlock()
+	f, present := comparators.byName[name]
+	return present && t.AssignableTo(f.Type().In(0))
+}
+
+// elementsAccepted tells whether the comparator registered with the name compares the elements of the slice,
+// array, or map type t.
+func elementsAccepted(name string, t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		elem := t.Elem()
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		return namedComparatorAccepts(name, elem)
+	}
+	return false
+}
+
+func funcComparator(f reflect.Value) comparator {
+	return func(a, b reflect.Value) bool {
+		argType := f.Type().In(0)
+		if !a.Type().AssignableTo(argType) || !b.Type().AssignableTo(argType) {
+			return false
+		}
+		return f.Call([]reflect.Value{a, b})[0].Bool()
+	}
+}
+
+// equalMethod returns the comparator calling the Equal(other T) bool method declared with a value or a pointer
+// receiver of T.
+func equalMethod(t reflect.Type) comparator {
+	isEqual := func(m reflect.Method, receiver reflect.Type) bool {
+		mt := m.Type
+		return mt.NumIn() == 2 && mt.In(0) == receiver && mt.In(1) == t && mt.NumOut() == 1 &&
+			mt.Out(0).Kind() == reflect.Bool
+	}
+	if m, present := t.MethodByName("Equal"); present && isEqual(m, t) {
+		return func(a, b reflect.Value) bool {
+			if a.Type() != t || b.Type() != t {
+				return false
+			}
+			return m.Func.Call([]reflect.Value{a, b})[0].Bool()
+		}
+	}
+	ptr := reflect.PtrTo(t)
+	if m, present := ptr.MethodByName("Equal"); present && isEqual(m, ptr) {
+		return func(a, b reflect.Value) bool {
+			if a.Type() != t || b.Type() != t {
+				return false
+			}
+			receiver := reflect.New(t)
+			receiver.Elem().Set(a)
+			return m.Func.Call([]reflect.Value{receiver, b})[0].Bool()
+		}
+	}
+	return nil
+}
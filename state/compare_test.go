@@ -0,0 +1,215 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type approx float64
+
+type pointerEqual struct{ Name string }
+
+func (pe *pointerEqual) Equal(other pointerEqual) bool {
+	return strings.EqualFold(pe.Name, other.Name)
+}
+
+func init() {
+	RegisterComparator(func(a, b approx) bool {
+		return math.Abs(float64(a-b)) < 1e-9
+	})
+	RegisterNamedComparator("fold", strings.EqualFold)
+	RegisterNamedComparator("len", func(a, b []string) bool {
+		return len(a) == 0 && len(b) == 0
+	})
+	// Asymmetric, so that the order of the arguments matters.
+	RegisterNamedComparator("grown", func(prev, next int) bool {
+		return next >= prev
+	})
+}
+
+type compared struct {
+	Ratio   approx
+	Name    string   `state:"cmp=fold"`
+	Tags    []string `state:"cmp=len"`
+	Created time.Time
+	Owner   *pointerEqual
+	Exact   string
+	Aliases []string          `state:"cmp=fold"`
+	Labels  map[string]string `state:"cmp=fold"`
+	Limit   int               `state:"cmp=grown"`
+}
+
+func TestComparators(t *testing.T) {
+	now := time.Now()
+	build := func(c compared) Set {
+		items, err := BuildStateItems(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	prev := build(compared{
+		Ratio: 0.3, Name: "Web", Tags: nil, Created: now, Owner: &pointerEqual{"admin"}, Exact: "a",
+		Aliases: []string{"www"}, Labels: map[string]string{"env": "prod"}, Limit: 1,
+	})
+	next := build(compared{
+		Ratio: 0.1 + 0.2, Name: "WEB", Tags: []string{}, Created: now.Round(0).In(time.UTC),
+		Owner: &pointerEqual{"Admin"}, Exact: "a",
+		Aliases: []string{"WWW"}, Labels: map[string]string{"env": "Prod"}, Limit: 2,
+	})
+	if p, err := NewPlan(prev, next); err != nil || !p.Empty() {
+		t.Errorf("Semantically equal values are changed: %v\n%s", err, p)
+	}
+
+	changed := build(compared{
+		Ratio: 0.3, Name: "Web", Created: now.Add(time.Second), Owner: &pointerEqual{"admin"}, Exact: "A",
+		Aliases: []string{"www", "web"}, Labels: map[string]string{"env": "prod"}, Limit: 0,
+	})
+	p, err := NewPlan(prev, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "update /Created,update /Exact,update /Aliases,create /Aliases/1,update /Limit"
+	if ids := planIds(t, p); strings.Join(ids, ",") != want {
+		t.Errorf("Unexpected changes: %v", ids)
+	}
+}
+
+type event struct {
+	At   time.Time
+	Name string `state:"cmp=fold"`
+}
+
+type renamedEvent struct {
+	Id string `state:"id"`
+	At time.Time
+	r  *recorder
+}
+
+func (re *renamedEvent) Rename(ctx context.Context, oldId string) error {
+	re.r.record("rename " + oldId)
+	return nil
+}
+
+func TestComparators_Content(t *testing.T) {
+	now := time.Now()
+	r := new(recorder)
+	build := func(v interface{}) Set {
+		items, err := BuildStateItems(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	type events struct {
+		Events []event `state:"lcs"`
+	}
+
+	p, err := NewPlan(
+		build(events{[]event{{At: now, Name: "a"}}}),
+		build(events{[]event{{At: now.Add(time.Hour), Name: "x"}, {At: now.Round(0).In(time.UTC), Name: "A"}}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := planIds(t, p); strings.Join(ids, ",") != "update /Events,create /Events/0,create /Events/0/At,create /Events/0/Name" {
+		t.Errorf("Unexpected changes: %v", ids)
+	}
+
+	p, err = NewPlan(
+		build([]*renamedEvent{{Id: "a", At: now, r: r}}),
+		build([]*renamedEvent{{Id: "b", At: now.Round(0).In(time.UTC), r: r}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := planIds(t, p); strings.Join(ids, ",") != "move /b" {
+		t.Errorf("Unexpected changes: %v", ids)
+	}
+}
+
+type equalRule struct {
+	Name  string `state:"id"`
+	Ports []int
+}
+
+func (er equalRule) Equal(other equalRule) bool {
+	return er.Name == other.Name && len(er.Ports) == len(other.Ports)
+}
+
+type equalSpace struct {
+	Area  int `validate:"min=1"`
+	Rooms []struct {
+		Name string `validate:"required"`
+	}
+}
+
+func (es equalSpace) Equal(other equalSpace) bool {
+	return es.Area == other.Area
+}
+
+func TestComparators_Structs(t *testing.T) {
+	items, err := BuildStateItems([]equalRule{{Name: "web"}, {Name: "db"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.Id())
+	}
+	if want := []string{"/web", "/db"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Compared structs are not identified: got %v, want %v", ids, want)
+	}
+	if _, err := BuildStateItems([]equalRule{{Name: "web"}, {Name: "web"}}); err == nil {
+		t.Error("No error for the duplicate IDs of compared structs")
+	}
+
+	_, err = BuildStateItems(struct{ Space equalSpace }{equalSpace{Rooms: []struct {
+		Name string `validate:"required"`
+	}{{}}}})
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Errors) != 2 || ve.Errors[0].Path != "/Space/Area" ||
+		ve.Errors[1].Path != "/Space/Rooms/0/Name" {
+		t.Errorf("Compared struct fields are not validated: %v", err)
+	}
+}
+
+func TestComparators_Errors(t *testing.T) {
+	if _, err := BuildStateItems(struct {
+		A string `state:"cmp=unknown"`
+	}{}); err == nil || err.Error() != `/A: unknown comparator "unknown"` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := BuildStateItems(struct {
+		A int `state:"cmp=fold"`
+	}{}); err == nil || err.Error() != `/A: comparator "fold" of string cannot compare int` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := BuildStateItems(struct {
+		A []int `state:"cmp=fold"`
+	}{}); err == nil || err.Error() != `/A: comparator "fold" of string cannot compare []int` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := BuildStateItems(struct {
+		A string `state:"id,cmp=fold"`
+	}{}); err == nil || !strings.Contains(err.Error(), `unknown option "cmp=fold" of "id"`) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	for _, fn := range []interface{}{nil, 42, func(a string, b int) bool { return false }, func(a, b string) {}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("No panic for %T", fn)
+				}
+			}()
+			RegisterComparator(fn)
+		}()
+	}
+}
@@ -0,0 +1,201 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Hasher may be implemented by items to provide their own content hash used by Hash.
+type Hasher interface {
+	ContentHash() []byte
+}
+
+// Hash returns a stable content hash of the item.
+// Items with equal hashes have the same ID and content.
+//
+// Values of the items built with BuildStateItems are hashed by their content, ComposedItems are hashed by their
+// actions and parts regardless of the parts order.
+// Other items are hashed with their ContentHash method if they implement Hasher, or by the content of the item value.
+func Hash(item Item) string {
+	return hex.EncodeToString(itemDigest(item))
+}
+
+// HashSet returns a stable content hash of the Set, which does not depend on the items order.
+func HashSet(items Set) string {
+	h := sha256.New()
+	writeSortedDigests(h, partDigests(items))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func partDigests(items []Item) [][]byte {
+	digests := make([][]byte, len(items))
+	for i, item := range items {
+		digests[i] = itemDigest(item)
+	}
+	return digests
+}
+
+func itemDigest(item Item) []byte {
+	if csi, ok := item.(ComposedItem); ok && csi.digest != nil {
+		return csi.digest
+	}
+
+	h := sha256.New()
+	switch it := item.(type) {
+	case valueStateItem:
+		writeString(h, "value")
+		writeString(h, it.Id())
+		writeValue(h, it.value, nil)
+	case ComposedItem:
+		writeString(h, "composed")
+		writeString(h, it.Id())
+		if actionsItem, ok := it.actions.(Item); ok {
+			h.Write(itemDigest(actionsItem))
+		}
+		if it.ordered {
+			writeString(h, "ordered")
+			writeDigests(h, partDigests(it.Parts))
+		} else {
+			writeSortedDigests(h, partDigests(it.Parts))
+		}
+	case Hasher:
+		writeString(h, "hasher")
+		writeString(h, item.Id())
+		h.Write(it.ContentHash())
+	default:
+		writeString(h, "item")
+		writeString(h, item.Id())
+		writeValue(h, reflect.ValueOf(item), nil)
+	}
+	return h.Sum(nil)
+}
+
+// cacheDigests computes and stores the hashes of all ComposedItems in the tree.
+// It must be called when the IDs are not going to change anymore.
+func cacheDigests(items []Item) {
+	for i, item := range items {
+		if csi, ok := item.(ComposedItem); ok {
+			cacheDigests(csi.Parts)
+			csi.digest = nil
+			csi.digest = itemDigest(csi)
+			items[i] = csi
+		}
+	}
+}
+
+func writeSortedDigests(h hash.Hash, digests [][]byte) {
+	sort.Slice(digests, func(i, j int) bool {
+		return bytes.Compare(digests[i], digests[j]) < 0
+	})
+	writeDigests(h, digests)
+}
+
+func writeDigests(h hash.Hash, digests [][]byte) {
+	writeInt(h, int64(len(digests)))
+	for _, d := range digests {
+		h.Write(d)
+	}
+}
+
+func writeString(h hash.Hash, s string) {
+	writeInt(h, int64(len(s)))
+	h.Write([]byte(s))
+}
+
+func writeInt(h hash.Hash, i int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	h.Write(buf[:])
+}
+
+// writeValue writes a deterministic encoding of v to h.
+// Pointers are followed, map entries are sorted, functions and channels are only checked for nil.
+func writeValue(h hash.Hash, v reflect.Value, visited map[uintptr]bool) {
+	if !v.IsValid() {
+		writeString(h, "<nil>")
+		return
+	}
+	writeString(h, v.Type().String())
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			writeInt(h, 1)
+		} else {
+			writeInt(h, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeInt(h, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeInt(h, int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		writeInt(h, int64(math.Float64bits(v.Float())))
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		writeInt(h, int64(math.Float64bits(real(c))))
+		writeInt(h, int64(math.Float64bits(imag(c))))
+	case reflect.String:
+		writeString(h, v.String())
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			writeString(h, "<nil>")
+			return
+		}
+		if v.Kind() == reflect.Ptr {
+			if visited == nil {
+				visited = make(map[uintptr]bool)
+			}
+			if visited[v.Pointer()] {
+				writeString(h, "<cycle>")
+				return
+			}
+			visited[v.Pointer()] = true
+			defer delete(visited, v.Pointer())
+		}
+		writeValue(h, v.Elem(), visited)
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			writeString(h, "<nil>")
+			return
+		}
+		writeInt(h, int64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			writeValue(h, v.Index(i), visited)
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			writeString(h, "<nil>")
+			return
+		}
+		entries := make([][]byte, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			eh := sha256.New()
+			writeValue(eh, iter.Key(), visited)
+			writeValue(eh, iter.Value(), visited)
+			entries = append(entries, eh.Sum(nil))
+		}
+		writeSortedDigests(h, entries)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			writeString(h, v.Type().Field(i).Name)
+			writeValue(h, v.Field(i), visited)
+		}
+
+	default:
+		// Functions, channels and unsafe pointers cannot be compared by content.
+		if v.IsNil() {
+			writeString(h, "<nil>")
+		}
+	}
+}
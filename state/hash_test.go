@@ -0,0 +1,84 @@
+package state
+
+import "testing"
+
+type hashedItem struct {
+	testStateItem
+	content string
+}
+
+func (hi hashedItem) ContentHash() []byte {
+	return []byte(hi.content)
+}
+
+func TestHash(t *testing.T) {
+	build := func(v interface{}) Set {
+		items, err := BuildStateItems(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	value := map[string]interface{}{"a": []int{1, 2}, "b": map[string]string{"x": "y"}, "c": 4.2}
+	valueCopy := map[string]interface{}{"c": 4.2, "b": map[string]string{"x": "y"}, "a": []int{1, 2}}
+	valueChanged := map[string]interface{}{"a": []int{2, 1}, "b": map[string]string{"x": "y"}, "c": 4.2}
+
+	if HashSet(build(value)) != HashSet(build(valueCopy)) {
+		t.Error("Hash of the same value is different")
+	}
+	if HashSet(build(value)) == HashSet(build(valueChanged)) {
+		t.Error("Hash of the changed value is the same")
+	}
+
+	csi := ComposedItem{IdValue: StringId("c"), Parts: stateItems([]testInput{{"1", "a"}, {"2", "b"}}, nil)}
+	csiReordered := ComposedItem{IdValue: StringId("c"), Parts: stateItems([]testInput{{"2", "b"}, {"1", "a"}}, nil)}
+	csiRenamed := ComposedItem{IdValue: StringId("d"), Parts: csi.Parts}
+	if Hash(csi) != Hash(csiReordered) {
+		t.Error("Hash of the ComposedItem depends on the parts order")
+	}
+	if Hash(csi) == Hash(csiRenamed) {
+		t.Error("Hash of the ComposedItem does not depend on its ID")
+	}
+
+	h1 := hashedItem{testStateItem{id: "h", arg: "a"}, "content"}
+	h2 := hashedItem{testStateItem{id: "h", arg: "b"}, "content"}
+	if Hash(h1) != Hash(h2) {
+		t.Error("Hasher implementation is ignored")
+	}
+}
+
+func TestHash_Cached(t *testing.T) {
+	items, err := BuildStateItems(makeTestStruct(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csi := items[0].(ComposedItem)
+	if csi.digest == nil {
+		t.Fatal("Digest is not cached")
+	}
+	for _, part := range csi.Parts {
+		if partCsi, ok := part.(ComposedItem); ok && partCsi.digest == nil {
+			t.Errorf("Digest is not cached for %s", part.Id())
+		}
+	}
+
+	cached := Hash(csi)
+	csi.digest = nil
+	if Hash(csi) != cached {
+		t.Error("Cached digest does not match the computed one")
+	}
+}
+
+func TestHashSet(t *testing.T) {
+	items := stateItems([]testInput{{"1", "a"}, {"2", "b"}}, nil)
+	reordered := stateItems([]testInput{{"2", "b"}, {"1", "a"}}, nil)
+	changed := stateItems([]testInput{{"1", "a"}, {"2", "c"}}, nil)
+
+	if HashSet(items) != HashSet(reordered) {
+		t.Error("Hash depends on the items order")
+	}
+	if HashSet(items) == HashSet(changed) {
+		t.Error("Hash does not depend on the items content")
+	}
+}
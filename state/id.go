@@ -3,6 +3,7 @@ package state
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // ItemId represents a unique state item ID.
@@ -48,15 +49,15 @@ func (vi *valueId) nextListId(index int) *valueId {
 	return res
 }
 
-func (vi *valueId) inject(id string) *valueId {
+func (vi *valueId) inject(id string) (*valueId, error) {
 	if vi != nil && len(vi.cachedId) > 0 {
-		panic(fmt.Errorf("state: inject with %s after cache value has been set on %s", id, vi.cachedId))
+		return nil, fmt.Errorf("cannot inject %s: ID %s is already used", id, vi.cachedId)
 	}
 
 	if vi != nil && vi.listMember {
 		// Replace list index with the provided ID.
 		vi.part = id
-		return vi
+		return vi, nil
 	}
 
 	inject := &valueId{part: id, parent: vi}
@@ -67,7 +68,7 @@ func (vi *valueId) inject(id string) *valueId {
 			ch.parent = inject
 		}
 	}
-	return inject
+	return inject, nil
 }
 
 func (vi *valueId) String() string {
@@ -80,7 +81,72 @@ func (vi *valueId) String() string {
 		if vi.parent != nil {
 			parent = vi.parent.String() + "/"
 		}
-		vi.cachedId = parent + vi.part
+		vi.cachedId = parent + escapeSegment(vi.part)
 	}
 	return vi.cachedId
 }
+
+// Path is an ID split into segments: struct field names, list item IDs or indexes, and map keys.
+//
+// Segments are escaped in the ID string the same way JSON Pointer (RFC 6901) does it: ~ is written as ~0 and
+// / is written as ~1, so that a segment containing a slash does not collide with a nested path.
+type Path []string
+
+// String returns the ID with the escaped segments, each of them prefixed with a slash.
+func (p Path) String() string {
+	var b strings.Builder
+	for _, segment := range p {
+		b.WriteByte('/')
+		b.WriteString(escapeSegment(segment))
+	}
+	return b.String()
+}
+
+// ParsePath splits the ID built by BuildStateItems into its unescaped segments.
+func ParsePath(id string) (Path, error) {
+	if id == "" {
+		return Path{}, nil
+	}
+	if id[0] != '/' {
+		return nil, fmt.Errorf("bad id %q: it does not start with /", id)
+	}
+	parts := strings.Split(id[1:], "/")
+	res := make(Path, len(parts))
+	for i, part := range parts {
+		segment, err := unescapeSegment(part)
+		if err != nil {
+			return nil, fmt.Errorf("bad id %q: %w", id, err)
+		}
+		res[i] = segment
+	}
+	return res, nil
+}
+
+var segmentEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapeSegment(segment string) string {
+	return segmentEscaper.Replace(segment)
+}
+
+func unescapeSegment(part string) (string, error) {
+	if !strings.Contains(part, "~") {
+		return part, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		if part[i] != '~' {
+			b.WriteByte(part[i])
+			continue
+		}
+		if i+1 == len(part) || (part[i+1] != '0' && part[i+1] != '1') {
+			return "", fmt.Errorf("bad escape sequence at %d in %q", i, part)
+		}
+		if part[i+1] == '0' {
+			b.WriteByte('~')
+		} else {
+			b.WriteByte('/')
+		}
+		i++
+	}
+	return b.String(), nil
+}
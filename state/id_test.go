@@ -0,0 +1,84 @@
+package state
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	tests := []struct {
+		id   string
+		path Path
+	}{
+		{id: "", path: Path{}},
+		{id: "/a/b", path: Path{"a", "b"}},
+		{id: "/a~1b", path: Path{"a/b"}},
+		{id: "/~0home~1~01/", path: Path{"~home/~1", ""}},
+		{id: "/", path: Path{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if got := tt.path.String(); got != tt.id {
+				t.Errorf("Unexpected ID: got %q, want %q", got, tt.id)
+			}
+			got, err := ParsePath(tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.path) {
+				t.Errorf("Unexpected path: got %q, want %q", got, tt.path)
+			}
+		})
+	}
+}
+
+func TestParsePath_Errors(t *testing.T) {
+	for _, id := range []string{"a/b", "/a~", "/a~2"} {
+		if _, err := ParsePath(id); err == nil || !strings.Contains(err.Error(), "bad id") {
+			t.Errorf("Unexpected error for %q: %v", id, err)
+		}
+	}
+}
+
+func TestBuildStateItems_EscapedIds(t *testing.T) {
+	type room struct {
+		Name string `state:"id"`
+		Size int
+	}
+	input := map[string]interface{}{
+		"a/b": 1,
+		"a":   map[string]int{"b": 2},
+		"rooms": []room{
+			{Name: "hall/kitchen", Size: 3},
+		},
+	}
+	items, err := BuildStateItems(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	var collect func(items []Item)
+	collect = func(items []Item) {
+		for _, item := range items {
+			ids = append(ids, item.Id())
+			if csi, ok := item.(ComposedItem); ok {
+				collect(csi.Parts)
+			}
+		}
+	}
+	collect(items)
+	want := []string{"/a", "/a/b", "/a~1b", "/rooms", "/rooms/hall~1kitchen", "/rooms/hall~1kitchen/Size"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Unexpected IDs: got %q, want %q", ids, want)
+	}
+
+	path, err := ParsePath(ids[len(ids)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(path, Path{"rooms", "hall/kitchen", "Size"}) {
+		t.Errorf("Unexpected path: %q", path)
+	}
+}
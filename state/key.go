@@ -0,0 +1,111 @@
+package state
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type mapKey struct {
+	value reflect.Value
+	id    string
+}
+
+// mapKeys returns the keys of the map with their ID parts, sorted by the IDs.
+// Distinct keys formatted the same way are reported as an error.
+func mapKeys(m reflect.Value) ([]mapKey, error) {
+	res := make([]mapKey, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		id, err := formatKey(k)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, mapKey{value: k, id: id})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].id < res[j].id
+	})
+	for i := 1; i < len(res); i++ {
+		if res[i].id == res[i-1].id {
+			return nil, fmt.Errorf("map keys %#v and %#v have the same ID %s",
+				res[i-1].value.Interface(), res[i].value.Interface(), res[i].id)
+		}
+	}
+	return res, nil
+}
+
+// formatKey formats a map key as an ID part.
+// Text marshalers and stringers are formatted with their methods, composite keys list their escaped components
+// in braces or brackets, and interface keys are prefixed with their dynamic types.
+func formatKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.Interface {
+		if k.IsNil() {
+			return "nil", nil
+		}
+		inner, err := formatKey(k.Elem())
+		if err != nil {
+			return "", err
+		}
+		return k.Elem().Type().String() + ":" + inner, nil
+	}
+	// Unexported fields of composite keys are formatted by their kinds.
+	if k.CanInterface() {
+		if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+			text, err := tm.MarshalText()
+			if err != nil {
+				return "", fmt.Errorf("cannot format map key %v: %w", k, err)
+			}
+			return string(text), nil
+		}
+		if s, ok := k.Interface().(fmt.Stringer); ok {
+			return s.String(), nil
+		}
+	}
+
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(k.Float(), 'g', -1, k.Type().Bits()), nil
+	case reflect.Complex64, reflect.Complex128:
+		return fmt.Sprint(k.Complex()), nil
+
+	case reflect.Struct, reflect.Array:
+		var parts []string
+		if k.Kind() == reflect.Struct {
+			parts = make([]string, k.NumField())
+		} else {
+			parts = make([]string, k.Len())
+		}
+		for i := range parts {
+			var field reflect.Value
+			if k.Kind() == reflect.Struct {
+				field = k.Field(i)
+			} else {
+				field = k.Index(i)
+			}
+			part, err := formatKey(field)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = keyEscaper.Replace(part)
+		}
+		if k.Kind() == reflect.Struct {
+			return "{" + strings.Join(parts, ",") + "}", nil
+		}
+		return "[" + strings.Join(parts, ",") + "]", nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", k.Type())
+}
+
+// keyEscaper escapes the components of the composite keys.
+var keyEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `{`, `\{`, `}`, `\}`, `[`, `\[`, `]`, `\]`)
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type keyColor int
+
+func (kc keyColor) String() string {
+	return [...]string{"red", "green"}[kc]
+}
+
+type keyName string
+
+func (kn keyName) String() string {
+	return strings.ToLower(string(kn))
+}
+
+type keyVersion struct {
+	Major, Minor int
+}
+
+func (kv keyVersion) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("v%d.%d", kv.Major, kv.Minor)), nil
+}
+
+type keyPoint struct {
+	X, Y string
+}
+
+func TestBuildStateItems_MapKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		input interface{}
+		want  []string
+	}{
+		{name: "ints", input: map[int]string{10: "a", -2: "b"}, want: []string{"/-2", "/10"}},
+		{name: "bools", input: map[bool]int{true: 1, false: 0}, want: []string{"/false", "/true"}},
+		{name: "floats", input: map[float64]int{1.5: 1}, want: []string{"/1.5"}},
+		{name: "stringer", input: map[keyColor]int{0: 1, 1: 2}, want: []string{"/green", "/red"}},
+		{name: "text marshaler", input: map[keyVersion]bool{{Major: 1, Minor: 2}: true}, want: []string{"/v1.2"}},
+		{name: "struct", input: map[keyPoint]int{{X: "a,b", Y: "c"}: 1, {X: "a", Y: "b,c"}: 2},
+			want: []string{`/{a,b\,c}`, `/{a\,b,c}`}},
+		{name: "array", input: map[[2]int]int{{1, 2}: 1}, want: []string{"/[1,2]"}},
+		{name: "interface", input: map[interface{}]int{1: 1, "1": 2}, want: []string{"/int:1", "/string:1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := BuildStateItems(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range items {
+				if csi, ok := item.(ComposedItem); ok {
+					for _, part := range csi.Parts {
+						got = append(got, part.Id())
+					}
+				} else {
+					got = append(got, item.Id())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unexpected IDs: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildStateItems_MapKeyErrors(t *testing.T) {
+	one, two := 1, 1
+	tests := []struct {
+		name    string
+		input   interface{}
+		wantErr string
+	}{
+		{name: "pointer", input: map[*int]int{&one: 1}, wantErr: "unsupported map key type *int"},
+		{name: "collision", input: map[keyName]int{"Red": 1, "red": 2}, wantErr: "have the same ID red"},
+		{name: "nested pointer", input: map[string]map[*int]int{"a": {&two: 1}}, wantErr: "/a: unsupported map key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildStateItems(tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
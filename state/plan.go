@@ -0,0 +1,899 @@
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Op is a kind of operation performed on a state item.
+type Op int
+
+const (
+	OpCreate Op = iota + 1
+	OpUpdate
+	OpRemove
+	// OpReplace removes the previous item and creates the next one. It is used when the item changes its type
+	// or when the changed item cannot be updated in place.
+	OpReplace
+	// OpMove changes the ID of the item without recreating it. If the content changes as well, the move is
+	// followed by OpUpdate.
+	OpMove
+)
+
+// ReplaceStrategy defines the order of the actions replacing an item.
+type ReplaceStrategy int
+
+const (
+	// RemoveBeforeCreate removes the previous item first. It is the default.
+	RemoveBeforeCreate ReplaceStrategy = iota
+	// CreateBeforeRemove creates the next item first, so that the resource is always available.
+	// Plan.Do removes the previous item at the end of the plan, after its dependents are updated.
+	CreateBeforeRemove
+)
+
+// ReplaceStrategySelector is implemented by the items selecting their own replacement strategy.
+// It takes precedence over the Replacement plan option, while the `state:"replace,create-before-remove"` tag of
+// the field forcing the replacement takes precedence over the item choice.
+type ReplaceStrategySelector interface {
+	ReplaceStrategy() ReplaceStrategy
+}
+
+// Replacer is implemented by the items deciding whether they can be updated in place.
+// From is the previous item, or the previous value for the items built by BuildStateItems.
+//
+// BuildStateItems also replaces a struct item when a field tagged with `state:"replace"` changes.
+type Replacer interface {
+	RequiresReplace(from interface{}) bool
+}
+
+// Renamer is implemented by the items which can be moved to another ID without being recreated.
+// OldId is the ID of the item in the previous state.
+//
+// NewPlan detects renames of such items: a removed item is moved instead when an item of the same type and
+// the same content, apart from the IDs, is created next to it. Other moves are declared with the Moved option.
+type Renamer interface {
+	Rename(ctx context.Context, oldId string) error
+}
+
+func (op Op) String() string {
+	switch op {
+	case OpCreate:
+		return "create"
+	case OpUpdate:
+		return "update"
+	case OpRemove:
+		return "remove"
+	case OpReplace:
+		return "replace"
+	case OpMove:
+		return "move"
+	default:
+		return fmt.Sprintf("Op(%d)", int(op))
+	}
+}
+
+// Change describes a transition of a single state item.
+type Change struct {
+	Op Op
+	// Before is the item from the previous state. It is nil for OpCreate.
+	// Its ID differs from the After one for OpMove and for the updates of the moved items.
+	Before Item
+	// After is the item from the next state. It is nil for OpRemove.
+	After Item
+	// Parts lists the changes of nested parts when both Before and After are ComposedItems.
+	// It is only set for OpUpdate.
+	Parts []Change
+	// Strategy defines the order of the actions for OpReplace.
+	Strategy ReplaceStrategy
+}
+
+// Id returns the ID of the changed item.
+func (c Change) Id() string {
+	if c.After != nil {
+		return c.After.Id()
+	}
+	return c.Before.Id()
+}
+
+func (c Change) Do(ctx context.Context) error {
+	return c.do(ctx, nil, nil)
+}
+
+// do performs the change and calls performed, if it is not nil, for the change and each of its performed parts.
+// If deferred is not nil, the removal of the items replaced with CreateBeforeRemove is appended to it instead of
+// being performed.
+func (c Change) do(ctx context.Context, deferred *[]Item, performed func(c Change)) error {
+	if err := c.perform(ctx, deferred, performed); err != nil {
+		return err
+	}
+	if performed != nil {
+		performed(c)
+	}
+	return nil
+}
+
+func (c Change) perform(ctx context.Context, deferred *[]Item, performed func(c Change)) error {
+	switch c.Op {
+	case OpCreate:
+		return c.After.Create(ctx)
+	case OpRemove:
+		return c.Before.Remove(ctx)
+	case OpReplace:
+		if c.Strategy == CreateBeforeRemove {
+			if err := c.After.Create(ctx); err != nil {
+				return err
+			}
+			if deferred != nil {
+				*deferred = append(*deferred, c.Before)
+				return nil
+			}
+			return c.Before.Remove(ctx)
+		}
+		if err := c.Before.Remove(ctx); err != nil {
+			return err
+		}
+		return c.After.Create(ctx)
+	case OpMove:
+		if r := renamerOf(c.After); r != nil {
+			return r.Rename(ctx, c.Before.Id())
+		}
+		// Only the ID in the state changes.
+		return nil
+	case OpUpdate:
+		after, afterComposed := c.After.(ComposedItem)
+		before, beforeComposed := c.Before.(ComposedItem)
+		if afterComposed && beforeComposed {
+			for _, part := range c.Parts {
+				if err := part.do(ctx, deferred, performed); err != nil {
+					return err
+				}
+			}
+			return after.updateSelf(ctx, before)
+		}
+		return c.After.Update(ctx, c.Before)
+	default:
+		return fmt.Errorf("unknown operation %s on %s", c.Op, c.Id())
+	}
+}
+
+// selfChanged tells whether the item itself is changed, and not only its nested parts.
+func (c Change) selfChanged() bool {
+	if c.Op != OpUpdate {
+		return true
+	}
+	after, afterComposed := c.After.(ComposedItem)
+	before, beforeComposed := c.Before.(ComposedItem)
+	if !afterComposed || !beforeComposed || len(c.Parts) == 0 {
+		return true
+	}
+	if item, ok := after.actions.(Item); ok {
+		otherItem, ok := before.actions.(Item)
+		return !ok || !item.IsSame(otherItem)
+	}
+	return false
+}
+
+// Plan is an inspectable set of changes required to move from one state Set to another.
+// Changes are ordered the same way they are performed: removes, updates, creates.
+type Plan struct {
+	Changes []Change
+
+	// The Sets the plan is computed from.
+	prev, next Set
+}
+
+// PlanOption configures NewPlan.
+type PlanOption func(cfg *planConfig)
+
+type planConfig struct {
+	maxRemoves     int
+	maxChangeRatio float64
+	replace        ReplaceStrategy
+	// moves maps the previous IDs of the moved items to the next ones.
+	moves map[string]string
+}
+
+// Moved declares that the item with the from ID in the previous state has the to ID in the next state.
+// The item is moved instead of being removed and created again, and so are its nested parts.
+// The item is renamed with its Rename method if it implements Renamer, otherwise only its ID in the state changes.
+// The option can be repeated. NewPlan fails if any of the IDs is not in the corresponding Set.
+func Moved(from, to string) PlanOption {
+	return func(cfg *planConfig) {
+		cfg.moves[from] = to
+	}
+}
+
+// Replacement selects the order of the actions replacing the items.
+func Replacement(strategy ReplaceStrategy) PlanOption {
+	return func(cfg *planConfig) {
+		cfg.replace = strategy
+	}
+}
+
+// MaxRemoves makes NewPlan fail if the plan removes more than n items.
+// Nested parts of the removed ComposedItems are counted as well.
+func MaxRemoves(n int) PlanOption {
+	return func(cfg *planConfig) {
+		cfg.maxRemoves = n
+	}
+}
+
+// MaxChangeRatio makes NewPlan fail if the share of changed items exceeds ratio, a value between 0 and 1.
+// Items are counted across the whole tree, including nested parts of ComposedItems.
+func MaxChangeRatio(ratio float64) PlanOption {
+	return func(cfg *planConfig) {
+		cfg.maxChangeRatio = ratio
+	}
+}
+
+// LimitError is returned by NewPlan when the plan exceeds one of the configured limits.
+type LimitError struct {
+	// Limit describes the exceeded limit.
+	Limit string
+	// Ids lists the items causing the violation.
+	Ids []string
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("plan exceeds the limit of %s: %s", le.Limit, strings.Join(le.Ids, ", "))
+}
+
+// NewPlan compares the prev and next Sets and returns the changes required to get to the next state.
+// It returns an error instead of panicking if the Sets have nil items or duplicate IDs.
+// Items changing their types between the Sets are replaced, and items changing their IDs are moved if the move
+// is declared with the Moved option or detected for a Renamer.
+func NewPlan(prev, next Set, opts ...PlanOption) (*Plan, error) {
+	cfg := planConfig{maxRemoves: -1, maxChangeRatio: -1, moves: make(map[string]string)}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if err := checkSet(prev); err != nil {
+		return nil, fmt.Errorf("previous state: %w", err)
+	}
+	if err := checkSet(next); err != nil {
+		return nil, fmt.Errorf("next state: %w", err)
+	}
+	if err := cfg.checkMoves(prev, next); err != nil {
+		return nil, err
+	}
+
+	changes, err := cfg.diff(prev, next)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{Changes: changes, prev: prev, next: next}
+	if err := p.checkLimits(&cfg, prev); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Do performs the changes.
+// Items replaced with the CreateBeforeRemove strategy coexist with their replacements until all the other changes
+// are performed, then they are removed in the reverse order.
+func (p *Plan) Do(ctx context.Context) error {
+	return p.do(ctx, nil)
+}
+
+func (p *Plan) do(ctx context.Context, performed func(c Change)) error {
+	var deferred []Item
+	for _, c := range p.Changes {
+		if err := c.do(ctx, &deferred, performed); err != nil {
+			return err
+		}
+	}
+	for i := len(deferred) - 1; i >= 0; i-- {
+		if err := deferred[i].Remove(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Moves returns the previous IDs of the moved items mapped to the next ones.
+// They can be used to rewrite a stored snapshot of the previous state.
+func (p *Plan) Moves() map[string]string {
+	res := make(map[string]string)
+	_ = p.Walk(func(c Change) error {
+		if c.Op == OpMove {
+			res[c.Before.Id()] = c.After.Id()
+		}
+		return nil
+	})
+	return res
+}
+
+// Empty tells whether the plan has no changes to perform.
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// Walk calls fn for every change in the plan, including changes of the nested parts.
+// Creation or removal of a ComposedItem is followed by the creation or removal of its every part.
+// Replacement is followed by the removal of the previous item parts and the creation of the next item parts.
+// Walking stops at the first error returned by fn.
+func (p *Plan) Walk(fn func(c Change) error) error {
+	return walkChanges(p.Changes, fn)
+}
+
+// String renders the plan in a human readable form, listing every change including the nested ones.
+func (p *Plan) String() string {
+	var (
+		b      strings.Builder
+		counts = make(map[Op]int)
+	)
+	_ = p.Walk(func(c Change) error {
+		counts[c.Op]++
+		switch c.Op {
+		case OpCreate:
+			fmt.Fprintf(&b, "  + %s%s\n", c.Id(), renderValue(" = ", c.After))
+		case OpRemove:
+			fmt.Fprintf(&b, "  - %s\n", c.Id())
+		case OpReplace:
+			// Replacement is counted both as a create and as a remove.
+			counts[OpCreate]++
+			counts[OpRemove]++
+			sign := "-/+"
+			if c.Strategy == CreateBeforeRemove {
+				sign = "+/-"
+			}
+			fmt.Fprintf(&b, "  %s %s%s%s\n", sign, c.Id(), renderValue(": ", c.Before), renderValue(" -> ", c.After))
+		case OpMove:
+			fmt.Fprintf(&b, "  > %s -> %s\n", c.Before.Id(), c.Id())
+		case OpUpdate:
+			method := ""
+			if name := UpdateMethod(c.After); name != "" {
+				method = " (" + name + ")"
+			}
+			fmt.Fprintf(&b, "  ~ %s%s%s%s\n", c.Id(), method, renderValue(": ", c.Before), renderValue(" -> ", c.After))
+		}
+		return nil
+	})
+	fmt.Fprintf(&b, "Plan: %d to create, %d to update, %d to remove", counts[OpCreate], counts[OpUpdate], counts[OpRemove])
+	if counts[OpMove] > 0 {
+		fmt.Fprintf(&b, ", %d to move", counts[OpMove])
+	}
+	b.WriteString(".\n")
+	return b.String()
+}
+
+func renderValue(prefix string, item Item) string {
+	if _, composed := item.(ComposedItem); composed {
+		return ""
+	}
+	if v, ok := Value(item); ok {
+		return fmt.Sprintf("%s%v", prefix, v)
+	}
+	return ""
+}
+
+// Digest returns a hash of the plan: the content of the Sets it is computed from and of every changed item.
+// It can be used to approve a particular plan in advance.
+func (p *Plan) Digest() string {
+	h := sha256.New()
+	writeString(h, HashSet(p.prev))
+	writeString(h, HashSet(p.next))
+	_ = p.Walk(func(c Change) error {
+		writeString(h, c.Op.String())
+		writeInt(h, int64(c.Strategy))
+		for _, item := range []Item{c.Before, c.After} {
+			if item == nil {
+				writeString(h, "")
+				continue
+			}
+			writeString(h, item.Id())
+			writeString(h, Hash(item))
+		}
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func walkChanges(changes []Change, fn func(c Change) error) error {
+	for _, c := range changes {
+		if err := fn(c); err != nil {
+			return err
+		}
+		var nested []Change
+		switch c.Op {
+		case OpCreate:
+			nested = expandChanges(c.After, OpCreate)
+		case OpRemove:
+			nested = expandChanges(c.Before, OpRemove)
+		case OpReplace:
+			nested = append(expandChanges(c.Before, OpRemove), expandChanges(c.After, OpCreate)...)
+		case OpMove:
+			// Nested changes of the moved item belong to the update following the move.
+		default:
+			nested = c.Parts
+		}
+		if err := walkChanges(nested, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expandChanges(item Item, op Op) []Change {
+	csi, ok := item.(ComposedItem)
+	if !ok {
+		return nil
+	}
+	res := make([]Change, len(csi.Parts))
+	for i, part := range csi.Parts {
+		if op == OpCreate {
+			res[i] = Change{Op: op, After: part}
+		} else {
+			res[i] = Change{Op: op, Before: part}
+		}
+	}
+	return res
+}
+
+func (p *Plan) checkLimits(cfg *planConfig, prev Set) error {
+	if cfg.maxRemoves < 0 && cfg.maxChangeRatio < 0 {
+		return nil
+	}
+
+	var removed, changed []string
+	creates := 0
+	_ = p.Walk(func(c Change) error {
+		if c.Op == OpRemove || c.Op == OpReplace {
+			removed = append(removed, c.Id())
+		}
+		if c.Op == OpCreate || c.Op == OpReplace {
+			creates++
+		}
+		if c.selfChanged() {
+			changed = append(changed, c.Id())
+		}
+		return nil
+	})
+
+	if cfg.maxRemoves >= 0 && len(removed) > cfg.maxRemoves {
+		return &LimitError{Limit: fmt.Sprintf("%d removes", cfg.maxRemoves), Ids: removed}
+	}
+	if cfg.maxChangeRatio >= 0 {
+		total := countItems(prev) + creates
+		if total > 0 && float64(len(changed))/float64(total) > cfg.maxChangeRatio {
+			return &LimitError{Limit: fmt.Sprintf("%g%% changed items", cfg.maxChangeRatio*100), Ids: changed}
+		}
+	}
+	return nil
+}
+
+// checkMoves verifies that the declared moves refer to the items of the Sets, and that the target of every move is
+// either free in the previous state or moved away before, so that no item is renamed over another one.
+func (cfg *planConfig) checkMoves(prev, next Set) error {
+	froms := make([]string, 0, len(cfg.moves))
+	for from := range cfg.moves {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		to := cfg.moves[from]
+		if !hasItem(prev, from) {
+			return fmt.Errorf("bad move of %s: the item is not in the previous state", from)
+		}
+		if !hasItem(next, to) {
+			return fmt.Errorf("bad move of %s to %s: the item is not in the next state", from, to)
+		}
+		visited := map[string]bool{from: true}
+		for target := to; hasItem(prev, target); {
+			if visited[target] {
+				return fmt.Errorf("bad move of %s to %s: the moves form a cycle", from, to)
+			}
+			visited[target] = true
+			moved := cfg.movedId(target)
+			if moved == target {
+				return fmt.Errorf("bad move of %s to %s: the target is in the previous state and not moved away", from, to)
+			}
+			target = moved
+		}
+	}
+	return nil
+}
+
+// hasItem tells whether the item with the id is in the set, including the nested parts.
+func hasItem(items []Item, id string) bool {
+	for _, item := range items {
+		if item.Id() == id {
+			return true
+		}
+		if csi, ok := item.(ComposedItem); ok && hasItem(csi.Parts, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// countItems returns the number of items in the set, including the nested parts.
+func countItems(items []Item) int {
+	res := len(items)
+	for _, item := range items {
+		if csi, ok := item.(ComposedItem); ok {
+			res += countItems(csi.Parts)
+		}
+	}
+	return res
+}
+
+func (cfg *planConfig) diff(prev, next []Item) ([]Change, error) {
+	nextState := mapState(next)
+
+	changes := make([]Change, 0, len(prev)+len(next))
+	var (
+		updates []Change
+		moves   []movedChanges
+		removed []Item
+	)
+	for _, prevItem := range prev {
+		id := cfg.movedId(prevItem.Id())
+		if nextItem, present := nextState[id]; present {
+			if _, moveRoot := cfg.moves[prevItem.Id()]; moveRoot {
+				c, err := cfg.moveChanges(prevItem, nextItem)
+				if err != nil {
+					return nil, err
+				}
+				moves = append(moves, movedChanges{from: prevItem.Id(), to: id, changes: c})
+			} else if !cfg.same(prevItem, nextItem) {
+				c, err := cfg.updateChange(prevItem, nextItem)
+				if err != nil {
+					return nil, err
+				}
+				updates = append(updates, c)
+			}
+			delete(nextState, id)
+		} else {
+			removed = append(removed, prevItem)
+		}
+	}
+	updates = append(updates, orderMoves(moves)...)
+
+	// A move is detected only if the removed item and the created one match each other and nothing else.
+	candidates := make([][]Item, len(removed))
+	matches := make(map[string]int)
+	for i, prevItem := range removed {
+		candidates[i] = cfg.moveCandidates(prevItem, next, nextState)
+		for _, nextItem := range candidates[i] {
+			matches[nextItem.Id()]++
+		}
+	}
+	for i, prevItem := range removed {
+		if len(candidates[i]) == 1 && matches[candidates[i][0].Id()] == 1 {
+			nextItem := candidates[i][0]
+			// The move is recorded, so that the parts of the moved item are matched.
+			cfg.moves[prevItem.Id()] = nextItem.Id()
+			updates = append(updates, Change{Op: OpMove, Before: prevItem, After: nextItem})
+			delete(nextState, nextItem.Id())
+		} else {
+			changes = append(changes, Change{Op: OpRemove, Before: prevItem})
+		}
+	}
+	changes = append(changes, updates...)
+
+	// Create in the order items are listed in the next state.
+	for _, nextItem := range next {
+		if item, pending := nextState[nextItem.Id()]; pending {
+			changes = append(changes, Change{Op: OpCreate, After: item})
+			delete(nextState, nextItem.Id())
+		}
+	}
+	return changes, nil
+}
+
+// moveChanges returns the changes of the item moved with the Moved option: OpMove followed by the update if
+// its content changes too.
+func (cfg *planConfig) moveChanges(prev, next Item) ([]Change, error) {
+	moved := prev.Id() != next.Id()
+	if moved && cfg.same(prev, next) {
+		return []Change{{Op: OpMove, Before: prev, After: next}}, nil
+	}
+	c, err := cfg.updateChange(prev, next)
+	if err != nil || !moved || c.Op == OpReplace {
+		return []Change{c}, err
+	}
+	return []Change{{Op: OpMove, Before: prev, After: next}, c}, nil
+}
+
+// movedChanges are the changes of the item moved with the Moved option.
+type movedChanges struct {
+	from, to string
+	changes  []Change
+}
+
+// orderMoves returns the changes of the moved items, so that the items are moved away before other items are moved
+// to their IDs. checkMoves guarantees that the moves do not form cycles.
+func orderMoves(moves []movedChanges) []Change {
+	pending := make(map[string]bool, len(moves))
+	for _, m := range moves {
+		pending[m.from] = true
+	}
+	var res []Change
+	for len(moves) > 0 {
+		var rest []movedChanges
+		for _, m := range moves {
+			if pending[m.to] && m.to != m.from {
+				rest = append(rest, m)
+				continue
+			}
+			res = append(res, m.changes...)
+			delete(pending, m.from)
+		}
+		if len(rest) == len(moves) {
+			// Unreachable with the checked moves.
+			for _, m := range rest {
+				res = append(res, m.changes...)
+			}
+			break
+		}
+		moves = rest
+	}
+	return res
+}
+
+// moveCandidates returns the pending items of the next state prev can be renamed to.
+func (cfg *planConfig) moveCandidates(prev Item, next []Item, nextState map[string]Item) []Item {
+	if renamerOf(prev) == nil {
+		return nil
+	}
+	var res []Item
+	for _, nextItem := range next {
+		if _, pending := nextState[nextItem.Id()]; !pending {
+			continue
+		}
+		if renamerOf(nextItem) == nil || itemType(prev) != itemType(nextItem) {
+			continue
+		}
+		// The parts are compared as if the item was moved.
+		cfg.moves[prev.Id()] = nextItem.Id()
+		if cfg.same(prev, nextItem) {
+			res = append(res, nextItem)
+		}
+		delete(cfg.moves, prev.Id())
+	}
+	return res
+}
+
+// movedId returns the ID the item with the previous id has in the next state.
+// The nested parts of the moved items are moved as well.
+func (cfg *planConfig) movedId(id string) string {
+	if to, moved := cfg.moves[id]; moved {
+		return to
+	}
+	from := ""
+	for prefix := range cfg.moves {
+		if len(prefix) > len(from) && strings.HasPrefix(id, prefix+"/") {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return id
+	}
+	return cfg.moves[from] + strings.TrimPrefix(id, from)
+}
+
+// same tells whether the items have the same content. The moved items are compared regardless of their IDs.
+func (cfg *planConfig) same(prev, next Item) bool {
+	if prev.Id() == next.Id() {
+		return next.IsSame(prev)
+	}
+	switch n := next.(type) {
+	case valueStateItem:
+		p, ok := prev.(valueStateItem)
+		return ok && sameValues(p, n)
+	case ComposedItem:
+		p, ok := prev.(ComposedItem)
+		if !ok || !sameValueType(p, n) || !sameActions(p, n) || len(p.Parts) != len(n.Parts) ||
+			p.ordered != n.ordered {
+			return false
+		}
+		if n.ordered && !sameOrder(p.Parts, n.Parts, cfg.movedId) {
+			return false
+		}
+		nextState := mapState(n.Parts)
+		for _, part := range p.Parts {
+			nextPart, present := nextState[cfg.movedId(part.Id())]
+			if !present || !cfg.same(part, nextPart) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func renamerOf(item Item) Renamer {
+	if r, ok := item.(Renamer); ok {
+		return r
+	}
+	if csi, ok := item.(ComposedItem); ok {
+		return csi.renamer
+	}
+	return nil
+}
+
+func (cfg *planConfig) updateChange(prev, next Item) (Change, error) {
+	replace := Change{Op: OpReplace, Before: prev, After: next, Strategy: cfg.replace}
+	if s, ok := next.(ReplaceStrategySelector); ok {
+		replace.Strategy = s.ReplaceStrategy()
+	} else if csi, ok := next.(ComposedItem); ok && csi.strategy != nil {
+		replace.Strategy = csi.strategy.ReplaceStrategy()
+	}
+	if itemType(prev) != itemType(next) {
+		// The item cannot be updated with a value of another type.
+		return replace, nil
+	}
+	if requiresReplace(prev, next) {
+		return replace, nil
+	}
+	c := Change{Op: OpUpdate, Before: prev, After: next}
+	if nextCsi, ok := next.(ComposedItem); ok {
+		if prevCsi, ok := prev.(ComposedItem); ok {
+			var err error
+			if nextCsi.lcs && prevCsi.lcs {
+				c.Parts, err = cfg.alignList(prevCsi.Parts, nextCsi.Parts)
+			} else {
+				c.Parts, err = cfg.diff(prevCsi.Parts, nextCsi.Parts)
+			}
+			if err != nil {
+				return c, err
+			}
+			for _, part := range c.Parts {
+				mark := replaceMarkOf(part.Before, part.After)
+				if mark.forced {
+					if mark.strategy != nil {
+						replace.Strategy = *mark.strategy
+					}
+					return replace, nil
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// alignList returns the changes of the list parts matched by their content.
+// Parts of the longest common subsequence are kept, other parts found between the same kept ones are updated
+// pairwise, the rest is removed or created.
+func (cfg *planConfig) alignList(prev, next []Item) ([]Change, error) {
+	var removes, updates, creates []Change
+	pi, ni := 0, 0
+	gap := func(prevEnd, nextEnd int) error {
+		for ; pi < prevEnd && ni < nextEnd; pi, ni = pi+1, ni+1 {
+			cfg.moves[prev[pi].Id()] = next[ni].Id()
+			c, err := cfg.updateChange(prev[pi], next[ni])
+			if err != nil {
+				return err
+			}
+			updates = append(updates, c)
+		}
+		for ; pi < prevEnd; pi++ {
+			removes = append(removes, Change{Op: OpRemove, Before: prev[pi]})
+		}
+		for ; ni < nextEnd; ni++ {
+			creates = append(creates, Change{Op: OpCreate, After: next[ni]})
+		}
+		return nil
+	}
+	for _, m := range lcs(prev, next, cfg.sameContent) {
+		if err := gap(m[0], m[1]); err != nil {
+			return nil, err
+		}
+		// The kept part can change its index.
+		cfg.moves[prev[pi].Id()] = next[ni].Id()
+		pi, ni = pi+1, ni+1
+	}
+	if err := gap(len(prev), len(next)); err != nil {
+		return nil, err
+	}
+	return append(append(removes, updates...), creates...), nil
+}
+
+// lcs returns the index pairs of the longest common subsequence of the a and b items.
+func lcs(a, b []Item, equal func(a, b Item) bool) [][2]int {
+	// lengths[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if equal(a[i], b[j]) {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	var res [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case equal(a[i], b[j]):
+			res = append(res, [2]int{i, j})
+			i, j = i+1, j+1
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return res
+}
+
+// sameContent compares the items regardless of their IDs. Composed items are compared part by part, so that the
+// comparators of the nested values are used.
+func (cfg *planConfig) sameContent(prev, next Item) bool {
+	if itemType(prev) != itemType(next) {
+		return false
+	}
+	from, moved := cfg.moves[prev.Id()]
+	cfg.moves[prev.Id()] = next.Id()
+	defer func() {
+		if moved {
+			cfg.moves[prev.Id()] = from
+		} else {
+			delete(cfg.moves, prev.Id())
+		}
+	}()
+	return cfg.same(prev, next)
+}
+
+func requiresReplace(prev, next Item) bool {
+	if r, ok := next.(Replacer); ok {
+		return r.RequiresReplace(prev)
+	}
+	if csi, ok := next.(ComposedItem); ok && csi.replacer != nil {
+		from, ok := Value(prev)
+		if !ok {
+			from = prev
+		}
+		return csi.replacer.RequiresReplace(from)
+	}
+	return false
+}
+
+// itemType returns the type of the value the item represents, so that it is possible to tell whether the
+// update of one item to another one can be performed.
+func itemType(item Item) reflect.Type {
+	switch it := item.(type) {
+	case valueStateItem:
+		if it.value.IsValid() {
+			return it.value.Type()
+		}
+	case ComposedItem:
+		if it.valueType != nil {
+			return it.valueType
+		}
+	}
+	return reflect.TypeOf(item)
+}
+
+// checkNil looks for nil items at every level of the tree.
+func checkNil(items []Item, parent string) error {
+	for i, item := range items {
+		if item == nil {
+			return &InvalidItemError{Parent: parent, Index: i, Reason: "nil item"}
+		}
+		if v := reflect.ValueOf(item); v.Kind() == reflect.Ptr && v.IsNil() {
+			return &InvalidItemError{Parent: parent, Index: i, Reason: fmt.Sprintf("nil %s item", v.Type())}
+		}
+		if csi, ok := item.(ComposedItem); ok {
+			if csi.IdValue == nil {
+				return &InvalidItemError{Parent: parent, Index: i, Reason: "composed item has no ID"}
+			}
+			if err := checkNil(csi.Parts, csi.Id()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
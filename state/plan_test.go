@@ -0,0 +1,847 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func planIds(t *testing.T, p *Plan) []string {
+	var res []string
+	err := p.Walk(func(c Change) error {
+		res = append(res, c.Op.String()+" "+c.Id())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestNewPlan(t *testing.T) {
+	var performedActions recorder
+	prev := Set{
+		ComposedItem{IdValue: StringId("c1"), Parts: stateItems([]testInput{{"c1/1", "a"}, {"c1/2", "b"}}, &performedActions)},
+		ComposedItem{IdValue: StringId("c2"), Parts: stateItems([]testInput{{"c2/1", "a"}}, &performedActions)},
+	}
+	next := Set{
+		ComposedItem{IdValue: StringId("c1"), Parts: stateItems([]testInput{{"c1/1", "a"}, {"c1/2", "c"}}, &performedActions)},
+		ComposedItem{IdValue: StringId("c3"), Parts: stateItems([]testInput{{"c3/1", "a"}}, &performedActions)},
+	}
+
+	p, err := NewPlan(prev, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Empty() {
+		t.Fatal("Plan is empty")
+	}
+
+	wantIds := []string{
+		"remove c2", "remove c2/1",
+		"update c1", "update c1/2",
+		"create c3", "create c3/1",
+	}
+	if got := planIds(t, p); !reflect.DeepEqual(got, wantIds) {
+		t.Errorf("Unexpected plan walk: got %v, want %v", got, wantIds)
+	}
+
+	if err := p.Do(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	want := recorder{"remove c2/1 with a", "update c1/2 with c from c1/2/b", "create c3/1 with a"}
+	if !reflect.DeepEqual(performedActions, want) {
+		t.Errorf("actions resulted in %v, want %v", performedActions, want)
+	}
+}
+
+func TestNewPlan_CreateOrder(t *testing.T) {
+	var performedActions recorder
+	next := stateItems([]testInput{{"3", "a"}, {"1", "b"}, {"2", "c"}, {"0", "d"}}, &performedActions)
+	for i := 0; i < 10; i++ {
+		performedActions = nil
+		if err := InferActions(nil, next).Do(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		want := recorder{"create 3 with a", "create 1 with b", "create 2 with c", "create 0 with d"}
+		if !reflect.DeepEqual(performedActions, want) {
+			t.Fatalf("actions resulted in %v, want %v", performedActions, want)
+		}
+	}
+}
+
+func TestNewPlan_Limits(t *testing.T) {
+	composed := func(id string, parts ...testInput) Item {
+		return ComposedItem{IdValue: StringId(id), Parts: stateItems(parts, nil)}
+	}
+	prev := Set{
+		composed("a", testInput{"a/1", "x"}, testInput{"a/2", "x"}),
+		composed("b", testInput{"b/1", "x"}),
+		composed("c", testInput{"c/1", "x"}),
+	}
+
+	tests := []struct {
+		name    string
+		next    Set
+		opts    []PlanOption
+		wantIds []string
+	}{
+		{
+			name:    "removes within limit",
+			next:    Set{prev[0], prev[1]},
+			opts:    []PlanOption{MaxRemoves(2)},
+			wantIds: nil,
+		},
+		{
+			name:    "too many removes",
+			next:    Set{prev[1]},
+			opts:    []PlanOption{MaxRemoves(2)},
+			wantIds: []string{"a", "a/1", "a/2", "c", "c/1"},
+		},
+		{
+			name:    "nested removes",
+			next:    Set{composed("a"), prev[1], prev[2]},
+			opts:    []PlanOption{MaxRemoves(1)},
+			wantIds: []string{"a/1", "a/2"},
+		},
+		{
+			name:    "change ratio within limit",
+			next:    Set{composed("a", testInput{"a/1", "y"}, testInput{"a/2", "x"}), prev[1], prev[2]},
+			opts:    []PlanOption{MaxChangeRatio(0.2)},
+			wantIds: nil,
+		},
+		{
+			name:    "change ratio exceeded",
+			next:    Set{composed("a", testInput{"a/1", "y"}, testInput{"a/2", "y"}), prev[1], prev[2]},
+			opts:    []PlanOption{MaxChangeRatio(0.2)},
+			wantIds: []string{"a/1", "a/2"},
+		},
+		{
+			name:    "wipe out",
+			next:    nil,
+			opts:    []PlanOption{MaxRemoves(100), MaxChangeRatio(0.5)},
+			wantIds: []string{"a", "a/1", "a/2", "b", "b/1", "c", "c/1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPlan(prev, tt.next, tt.opts...)
+			if tt.wantIds == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p == nil {
+					t.Error("Plan is nil")
+				}
+				return
+			}
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(limitErr.Ids, tt.wantIds) {
+				t.Errorf("Unexpected offending IDs: got %v, want %v", limitErr.Ids, tt.wantIds)
+			}
+		})
+	}
+}
+
+func TestNewPlan_Errors(t *testing.T) {
+	r := new(recorder)
+	tests := []struct {
+		name       string
+		prev, next Set
+		wantErr    string
+	}{
+		{name: "nil item", next: Set{testStateItem{id: "a", recorder: r}, nil}, wantErr: "next state: nil item at [1]"},
+		{name: "nil part", prev: Set{ComposedItem{IdValue: StringId("b"), Parts: []Item{nil}}},
+			wantErr: "previous state: nil item at b[0]"},
+		{name: "no id", prev: Set{ComposedItem{}}, wantErr: "previous state: composed item has no ID at [0]"},
+		{name: "typed nil item", next: Set{(*StringItem)(nil)}, wantErr: "next state: nil *state.StringItem item at [0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPlan(tt.prev, tt.next)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+			var invalid *InvalidItemError
+			if !errors.As(err, &invalid) {
+				t.Errorf("Unexpected error type %T", err)
+			}
+		})
+	}
+	if len(*r) != 0 {
+		t.Errorf("Actions are performed: %s", r)
+	}
+}
+
+func TestComposedItem_NoPanics(t *testing.T) {
+	csi := ComposedItem{IdValue: StringId("a")}
+	if csi.IsSame(nil) {
+		t.Error("Composed item is the same as nil")
+	}
+	err := csi.Update(context.Background(), &StringItem{IdValue: "a"})
+	if err == nil || !strings.Contains(err.Error(), "is not a ComposedItem") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+type replacedValue struct {
+	Value string
+	r     *recorder
+}
+
+func (rv *replacedValue) Create(ctx context.Context) error {
+	rv.r.record("create value " + rv.Value)
+	return nil
+}
+
+func (rv *replacedValue) Remove(ctx context.Context) error {
+	rv.r.record("remove value " + rv.Value)
+	return nil
+}
+
+type replacedList struct {
+	Values []string
+	r      *recorder
+}
+
+func (rl *replacedList) Create(ctx context.Context) error {
+	rl.r.record(fmt.Sprint("create list ", rl.Values))
+	return nil
+}
+
+func (rl *replacedList) Remove(ctx context.Context) error {
+	rl.r.record(fmt.Sprint("remove list ", rl.Values))
+	return nil
+}
+
+func TestNewPlan_Replace(t *testing.T) {
+	r := new(recorder)
+	single := func(value interface{}) Set {
+		items, err := BuildStateItems(map[string]interface{}{"a": value, "b": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	tests := []struct {
+		name       string
+		prev, next Set
+		want       []string
+		performed  []string
+	}{
+		{
+			name:      "item type",
+			prev:      Set{testStateItem{id: "a", arg: "1", recorder: r}},
+			next:      Set{&StringItem{Actionable: testStateItem{id: "a", arg: "2", recorder: r}, IdValue: "a"}},
+			want:      []string{"replace a"},
+			performed: []string{"remove a with 1", "create a with 2"},
+		},
+		{
+			name: "value type",
+			prev: single(1),
+			next: single("1"),
+			want: []string{"replace /a"},
+		},
+		{
+			name:      "composition",
+			prev:      single(&replacedValue{Value: "x", r: r}),
+			next:      single(&replacedList{Values: []string{"y"}, r: r}),
+			want:      []string{"replace /a", "remove /a/Value", "create /a/Values", "create /a/Values/0"},
+			performed: []string{"remove value x", "create list [y]"},
+		},
+		{
+			name: "list to map",
+			prev: single([]string{"x"}),
+			next: single(map[string]string{"0": "x"}),
+			want: []string{"replace /a", "remove /a/0", "create /a/0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*r = nil
+			p, err := NewPlan(tt.prev, tt.next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := planIds(t, p); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unexpected changes: got %v, want %v", got, tt.want)
+			}
+			if err := p.Do(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(*r), tt.performed) {
+				t.Errorf("Unexpected actions: got %v, want %v", *r, tt.performed)
+			}
+		})
+	}
+
+	_, err := NewPlan(single(1), single("2"), MaxRemoves(0))
+	var le *LimitError
+	if !errors.As(err, &le) {
+		t.Errorf("Replacement is not limited as a remove: %v", err)
+	}
+	p, err := NewPlan(single(1), single("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := p.String(); out != "  -/+ /a: 1 -> 2\nPlan: 1 to create, 0 to update, 1 to remove.\n" {
+		t.Errorf("Unexpected plan rendering:\n%s", out)
+	}
+	bound, err := p.Save().Bind(single(1), single("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound.String() != p.String() {
+		t.Errorf("Unexpected bound plan:\n%s", bound)
+	}
+}
+
+type forcedRoom struct {
+	Name  string `state:"id"`
+	Floor string `state:"replace"`
+	Color string `state:"Repaint"`
+	r     *recorder
+}
+
+func (fr *forcedRoom) Create(ctx context.Context) error {
+	fr.r.record(fmt.Sprintf("create %s with %s floor", fr.Name, fr.Floor))
+	return nil
+}
+
+func (fr *forcedRoom) Remove(ctx context.Context) error {
+	fr.r.record(fmt.Sprintf("remove %s with %s floor", fr.Name, fr.Floor))
+	return nil
+}
+
+func (fr *forcedRoom) Repaint(ctx context.Context, prev string) error {
+	fr.r.record(fmt.Sprintf("repaint %s to %s", fr.Name, fr.Color))
+	return nil
+}
+
+type sizedRoom struct {
+	Name string `state:"id"`
+	Size int
+	r    *recorder
+}
+
+func (sr sizedRoom) RequiresReplace(from interface{}) bool {
+	return from.(sizedRoom).Size > sr.Size
+}
+
+func (sr sizedRoom) Create(ctx context.Context) error {
+	sr.r.record(fmt.Sprintf("create %s of size %d", sr.Name, sr.Size))
+	return nil
+}
+
+func (sr sizedRoom) Remove(ctx context.Context) error {
+	sr.r.record(fmt.Sprintf("remove %s of size %d", sr.Name, sr.Size))
+	return nil
+}
+
+func (sr sizedRoom) Update(ctx context.Context, from interface{}) error {
+	sr.r.record(fmt.Sprintf("grow %s to %d", sr.Name, sr.Size))
+	return nil
+}
+
+func TestNewPlan_ForceReplace(t *testing.T) {
+	r := new(recorder)
+	build := func(input interface{}) Set {
+		items, err := BuildStateItems(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	tests := []struct {
+		name       string
+		prev, next interface{}
+		opts       []PlanOption
+		plan       string
+		performed  []string
+	}{
+		{
+			name:      "update method",
+			prev:      []*forcedRoom{{Name: "hall", Floor: "wood", Color: "white", r: r}},
+			next:      []*forcedRoom{{Name: "hall", Floor: "wood", Color: "red", r: r}},
+			plan:      "  ~ /hall\n  ~ /hall/Color (Repaint): white -> red\n",
+			performed: []string{"repaint hall to red"},
+		},
+		{
+			name:      "replace tag",
+			prev:      []*forcedRoom{{Name: "hall", Floor: "wood", Color: "white", r: r}},
+			next:      []*forcedRoom{{Name: "hall", Floor: "tile", Color: "red", r: r}},
+			plan:      "  -/+ /hall\n  - /hall/Floor\n  - /hall/Color\n  + /hall/Floor = tile\n  + /hall/Color = red\n",
+			performed: []string{"remove hall with wood floor", "create hall with tile floor"},
+		},
+		{
+			name:      "create before remove",
+			prev:      []*forcedRoom{{Name: "hall", Floor: "wood", r: r}},
+			next:      []*forcedRoom{{Name: "hall", Floor: "tile", r: r}},
+			opts:      []PlanOption{Replacement(CreateBeforeRemove)},
+			plan:      "  +/- /hall\n  - /hall/Floor\n  - /hall/Color\n  + /hall/Floor = tile\n  + /hall/Color = \n",
+			performed: []string{"create hall with tile floor", "remove hall with wood floor"},
+		},
+		{
+			name:      "replacer allows update",
+			prev:      []sizedRoom{{Name: "hall", Size: 1, r: r}},
+			next:      []sizedRoom{{Name: "hall", Size: 2, r: r}},
+			plan:      "  ~ /hall\n  ~ /hall/Size: 1 -> 2\n",
+			performed: []string{"grow hall to 2"},
+		},
+		{
+			name:      "replacer requires replace",
+			prev:      []sizedRoom{{Name: "hall", Size: 2, r: r}},
+			next:      []sizedRoom{{Name: "hall", Size: 1, r: r}},
+			plan:      "  -/+ /hall\n  - /hall/Size\n  + /hall/Size = 1\n",
+			performed: []string{"remove hall of size 2", "create hall of size 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*r = nil
+			prev, next := build(tt.prev), build(tt.next)
+			p, err := NewPlan(prev, next, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := p.String(); !strings.HasPrefix(out, tt.plan) {
+				t.Errorf("Unexpected plan:\n%s", out)
+			}
+			bound, err := p.Save().Bind(prev, next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bound.Do(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(*r), tt.performed) {
+				t.Errorf("Unexpected actions: got %v, want %v", *r, tt.performed)
+			}
+		})
+	}
+}
+
+type blueGreenServer struct {
+	Name    string `state:"id"`
+	Version string `state:"replace,create-before-remove"`
+	r       *recorder
+}
+
+func (bgs *blueGreenServer) Create(ctx context.Context) error {
+	bgs.r.record(fmt.Sprintf("start %s %s", bgs.Name, bgs.Version))
+	return nil
+}
+
+func (bgs *blueGreenServer) Remove(ctx context.Context) error {
+	bgs.r.record(fmt.Sprintf("stop %s %s", bgs.Name, bgs.Version))
+	return nil
+}
+
+type selectingRoom struct {
+	Name string `state:"id"`
+	Size int    `state:"replace"`
+	r    *recorder
+}
+
+func (sr *selectingRoom) ReplaceStrategy() ReplaceStrategy {
+	return CreateBeforeRemove
+}
+
+func (sr *selectingRoom) Create(ctx context.Context) error {
+	sr.r.record(fmt.Sprintf("create %s of size %d", sr.Name, sr.Size))
+	return nil
+}
+
+func (sr *selectingRoom) Remove(ctx context.Context) error {
+	sr.r.record(fmt.Sprintf("remove %s of size %d", sr.Name, sr.Size))
+	return nil
+}
+
+type balancer struct {
+	Backend string `state:"Point"`
+	r       *recorder
+}
+
+func (b *balancer) Point(ctx context.Context, prev string) error {
+	b.r.record("point to " + b.Backend)
+	return nil
+}
+
+type site struct {
+	Servers  []*blueGreenServer
+	Rooms    []*selectingRoom
+	Balancer *balancer
+}
+
+func TestPlan_CreateBeforeRemove(t *testing.T) {
+	r := new(recorder)
+	build := func(version string, size int) Set {
+		items, err := BuildStateItems(site{
+			Servers:  []*blueGreenServer{{Name: "web", Version: version, r: r}},
+			Rooms:    []*selectingRoom{{Name: "hall", Size: size, r: r}},
+			Balancer: &balancer{Backend: "web " + version, r: r},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	p, err := NewPlan(build("v1", 2), build("v2", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := p.String(); !strings.Contains(out, "  +/- /Servers/web\n") || !strings.Contains(out, "  +/- /Rooms/hall\n") {
+		t.Errorf("Unexpected plan:\n%s", out)
+	}
+	if err := p.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"start web v2",
+		"create hall of size 1",
+		"point to web v2",
+		"remove hall of size 2",
+		"stop web v1",
+	}
+	if !reflect.DeepEqual([]string(*r), want) {
+		t.Errorf("Unexpected actions:\ngot  %v\nwant %v", *r, want)
+	}
+
+	// A single change does not defer the removal.
+	*r = nil
+	c := p.Changes[0].Parts[0]
+	if err := c.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"start web v2", "stop web v1"}; !reflect.DeepEqual([]string(*r), want) {
+		t.Errorf("Unexpected actions of a single change %s: %v", c.Id(), *r)
+	}
+}
+
+type bucket struct {
+	Name string `state:"id"`
+	Size int
+	r    *recorder
+}
+
+func (b *bucket) Create(ctx context.Context) error {
+	b.r.record("create " + b.Name)
+	return nil
+}
+
+func (b *bucket) Remove(ctx context.Context) error {
+	b.r.record("remove " + b.Name)
+	return nil
+}
+
+func (b *bucket) Rename(ctx context.Context, oldId string) error {
+	b.r.record(fmt.Sprintf("rename %s to %s", oldId, b.Name))
+	return nil
+}
+
+func TestNewPlan_Move(t *testing.T) {
+	r := new(recorder)
+	buckets := func(values ...*bucket) Set {
+		for _, b := range values {
+			b.r = r
+		}
+		items, err := BuildStateItems(struct{ Buckets []*bucket }{values})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	values := func(v map[string]int) Set {
+		items, err := BuildStateItems(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	tests := []struct {
+		name       string
+		prev, next Set
+		opts       []PlanOption
+		plan       string
+		moves      map[string]string
+		performed  []string
+	}{
+		{
+			name: "detected rename",
+			prev: buckets(&bucket{Name: "a", Size: 1}, &bucket{Name: "c", Size: 3}),
+			next: buckets(&bucket{Name: "b", Size: 1}, &bucket{Name: "c", Size: 3}),
+			plan: "  ~ /Buckets\n" +
+				"  > /Buckets/a -> /Buckets/b\n" +
+				"Plan: 0 to create, 1 to update, 0 to remove, 1 to move.\n",
+			moves:     map[string]string{"/Buckets/a": "/Buckets/b"},
+			performed: []string{"rename /Buckets/a to b"},
+		},
+		{
+			name: "changed content is not detected",
+			prev: buckets(&bucket{Name: "a", Size: 1}),
+			next: buckets(&bucket{Name: "b", Size: 2}),
+			plan: "  ~ /Buckets\n" +
+				"  - /Buckets/a\n" +
+				"  - /Buckets/a/Size\n" +
+				"  + /Buckets/b\n" +
+				"  + /Buckets/b/Size = 2\n" +
+				"Plan: 2 to create, 1 to update, 2 to remove.\n",
+			moves:     map[string]string{},
+			performed: []string{"remove a", "create b"},
+		},
+		{
+			name: "declared move with update",
+			prev: buckets(&bucket{Name: "a", Size: 1}),
+			next: buckets(&bucket{Name: "b", Size: 2}),
+			opts: []PlanOption{Moved("/Buckets/a", "/Buckets/b")},
+			plan: "  ~ /Buckets\n" +
+				"  > /Buckets/a -> /Buckets/b\n" +
+				"  ~ /Buckets/b\n" +
+				"  ~ /Buckets/b/Size: 1 -> 2\n" +
+				"Plan: 0 to create, 3 to update, 0 to remove, 1 to move.\n",
+			moves:     map[string]string{"/Buckets/a": "/Buckets/b"},
+			performed: []string{"rename /Buckets/a to b"},
+		},
+		{
+			name: "declared move of a value",
+			prev: values(map[string]int{"a": 1, "c": 3}),
+			next: values(map[string]int{"b": 1, "c": 3}),
+			opts: []PlanOption{Moved("/a", "/b")},
+			plan: "  > /a -> /b\n" +
+				"Plan: 0 to create, 0 to update, 0 to remove, 1 to move.\n",
+			moves: map[string]string{"/a": "/b"},
+		},
+		{
+			name: "ambiguous rename is not detected",
+			prev: buckets(&bucket{Name: "a"}, &bucket{Name: "b"}),
+			next: buckets(&bucket{Name: "c"}),
+			plan: "  ~ /Buckets\n" +
+				"  - /Buckets/a\n" +
+				"  - /Buckets/a/Size\n" +
+				"  - /Buckets/b\n" +
+				"  - /Buckets/b/Size\n" +
+				"  + /Buckets/c\n" +
+				"  + /Buckets/c/Size = 0\n" +
+				"Plan: 2 to create, 1 to update, 4 to remove.\n",
+			moves:     map[string]string{},
+			performed: []string{"remove a", "remove b", "create c"},
+		},
+		{
+			name: "chained moves",
+			prev: buckets(&bucket{Name: "a", Size: 1}, &bucket{Name: "b", Size: 2}),
+			next: buckets(&bucket{Name: "b", Size: 1}, &bucket{Name: "c", Size: 2}),
+			opts: []PlanOption{Moved("/Buckets/a", "/Buckets/b"), Moved("/Buckets/b", "/Buckets/c")},
+			plan: "  ~ /Buckets\n" +
+				"  > /Buckets/b -> /Buckets/c\n" +
+				"  > /Buckets/a -> /Buckets/b\n" +
+				"Plan: 0 to create, 1 to update, 0 to remove, 2 to move.\n",
+			moves:     map[string]string{"/Buckets/a": "/Buckets/b", "/Buckets/b": "/Buckets/c"},
+			performed: []string{"rename /Buckets/b to c", "rename /Buckets/a to b"},
+		},
+		{
+			name: "undetected move of a value",
+			prev: values(map[string]int{"a": 1}),
+			next: values(map[string]int{"b": 1}),
+			plan: "  - /a\n" +
+				"  + /b = 1\n" +
+				"Plan: 1 to create, 0 to update, 1 to remove.\n",
+			moves: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPlan(tt.prev, tt.next, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := p.String(); out != tt.plan {
+				t.Errorf("Unexpected plan:\n%s\nwant\n%s", out, tt.plan)
+			}
+			if moves := p.Moves(); !reflect.DeepEqual(moves, tt.moves) {
+				t.Errorf("Unexpected moves: got %v, want %v", moves, tt.moves)
+			}
+
+			data, err := json.Marshal(p.Save())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved SavedPlan
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatal(err)
+			}
+			bound, err := saved.Bind(tt.prev, tt.next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound.String() != tt.plan {
+				t.Errorf("Unexpected bound plan:\n%s", bound)
+			}
+
+			*r = nil
+			if err := bound.Do(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(*r), tt.performed) {
+				t.Errorf("Unexpected actions: got %v, want %v", *r, tt.performed)
+			}
+		})
+	}
+
+	prev, next := buckets(&bucket{Name: "a", Size: 1}), buckets(&bucket{Name: "b", Size: 2})
+	for _, move := range [][2]string{{"/Buckets/x", "/Buckets/b"}, {"/Buckets/a", "/Buckets/x"}} {
+		if _, err := NewPlan(prev, next, Moved(move[0], move[1])); err == nil ||
+			!strings.Contains(err.Error(), "/Buckets/x") {
+			t.Errorf("Unexpected error of the unknown move %s -> %s: %v", move[0], move[1], err)
+		}
+	}
+
+	prev, next = buckets(&bucket{Name: "a"}, &bucket{Name: "b"}), buckets(&bucket{Name: "a"}, &bucket{Name: "b"})
+	if _, err := NewPlan(prev, next, Moved("/Buckets/a", "/Buckets/b"), Moved("/Buckets/b", "/Buckets/a")); err == nil ||
+		!strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Unexpected error of the swap: %v", err)
+	}
+	if _, err := NewPlan(prev, next, Moved("/Buckets/a", "/Buckets/b")); err == nil ||
+		!strings.Contains(err.Error(), "not moved away") {
+		t.Errorf("Unexpected error of the move to an existing item: %v", err)
+	}
+}
+
+type firewallRule struct {
+	Port int
+	r    *recorder
+}
+
+func (fr *firewallRule) Create(ctx context.Context) error {
+	fr.r.record(fmt.Sprintf("open %d", fr.Port))
+	return nil
+}
+
+func (fr *firewallRule) Remove(ctx context.Context) error {
+	fr.r.record(fmt.Sprintf("close %d", fr.Port))
+	return nil
+}
+
+type firewall struct {
+	Names []string        `state:"lcs"`
+	Rules []*firewallRule `state:"lcs"`
+	Index []string
+}
+
+func TestNewPlan_Lcs(t *testing.T) {
+	r := new(recorder)
+	build := func(names []string, ports ...int) Set {
+		fw := firewall{Names: names, Index: names}
+		for _, port := range ports {
+			fw.Rules = append(fw.Rules, &firewallRule{Port: port, r: r})
+		}
+		items, err := BuildStateItems(fw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	tests := []struct {
+		name       string
+		prev, next Set
+		plan       string
+		performed  []string
+	}{
+		{
+			name: "insert",
+			prev: build([]string{"b", "c"}),
+			next: build([]string{"a", "b", "c"}),
+			plan: "  ~ /Names\n" +
+				"  + /Names/0 = a\n" +
+				"  ~ /Index\n" +
+				"  ~ /Index/0: b -> a\n" +
+				"  ~ /Index/1: c -> b\n" +
+				"  + /Index/2 = c\n" +
+				"Plan: 2 to create, 4 to update, 0 to remove.\n",
+		},
+		{
+			name: "substitute",
+			prev: build([]string{"a", "b", "c"}),
+			next: build([]string{"a", "x", "c"}),
+			plan: "  ~ /Names\n" +
+				"  ~ /Names/1: b -> x\n" +
+				"  ~ /Index\n" +
+				"  ~ /Index/1: b -> x\n" +
+				"Plan: 0 to create, 4 to update, 0 to remove.\n",
+		},
+		{
+			name: "structs",
+			prev: build(nil, 22, 80, 443),
+			next: build(nil, 80, 443, 8080),
+			plan: "  ~ /Rules\n" +
+				"  - /Rules/0\n" +
+				"  - /Rules/0/Port\n" +
+				"  + /Rules/2\n" +
+				"  + /Rules/2/Port = 8080\n" +
+				"Plan: 2 to create, 1 to update, 2 to remove.\n",
+			performed: []string{"close 22", "open 8080"},
+		},
+		{
+			name: "struct update",
+			prev: build(nil, 22, 80),
+			next: build(nil, 2222, 80),
+			plan: "  ~ /Rules\n" +
+				"  ~ /Rules/0\n" +
+				"  ~ /Rules/0/Port: 22 -> 2222\n" +
+				"Plan: 0 to create, 3 to update, 0 to remove.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPlan(tt.prev, tt.next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out := p.String(); out != tt.plan {
+				t.Errorf("Unexpected plan:\n%s\nwant\n%s", out, tt.plan)
+			}
+
+			data, err := json.Marshal(p.Save())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved SavedPlan
+			if err := json.Unmarshal(data, &saved); err != nil {
+				t.Fatal(err)
+			}
+			bound, err := saved.Bind(tt.prev, tt.next)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound.String() != tt.plan {
+				t.Errorf("Unexpected bound plan:\n%s", bound)
+			}
+
+			*r = nil
+			if err := bound.Do(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(*r), tt.performed) {
+				t.Errorf("Unexpected actions: got %v, want %v", *r, tt.performed)
+			}
+		})
+	}
+
+	if _, err := BuildStateItems(struct {
+		A string `state:"lcs"`
+	}{}); err == nil || err.Error() != "lcs field A is not a slice or an array" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Severity defines how a policy finding affects the plan execution.
+type Severity int
+
+const (
+	// Warn findings are reported, but do not prevent the plan from running.
+	Warn Severity = iota + 1
+	// Deny findings prevent the plan from running.
+	Deny
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Warn:
+		return "warn"
+	case Deny:
+		return "deny"
+	default:
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+}
+
+// Finding is a single result of a policy evaluation.
+type Finding struct {
+	Severity Severity
+	// Id of the item the finding is related to. It may be empty if the finding is related to the whole plan.
+	Id      string
+	Message string
+}
+
+func (f Finding) String() string {
+	if f.Id == "" {
+		return fmt.Sprintf("%s: %s", f.Severity, f.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", f.Severity, f.Id, f.Message)
+}
+
+// Policy validates a plan before it is performed.
+type Policy interface {
+	Evaluate(ctx context.Context, p *Plan) []Finding
+}
+
+// PolicyFunc is a Policy implemented with a single function.
+type PolicyFunc func(ctx context.Context, p *Plan) []Finding
+
+func (pf PolicyFunc) Evaluate(ctx context.Context, p *Plan) []Finding {
+	return pf(ctx, p)
+}
+
+// PolicyError is returned when at least one of the policies denies the plan.
+type PolicyError struct {
+	// Findings lists all the findings of the evaluated policies, including warnings.
+	Findings []Finding
+}
+
+func (pe *PolicyError) Error() string {
+	var denials []string
+	for _, f := range pe.Findings {
+		if f.Severity == Deny {
+			denials = append(denials, f.String())
+		}
+	}
+	return "plan denied by policy: " + strings.Join(denials, "; ")
+}
+
+// Executor performs plans, validating them with the registered policies first.
+type Executor struct {
+	Policies []Policy
+	// Report is called with every policy finding before any action runs.
+	Report func(f Finding)
+	// Approver, if set, is asked to confirm every non-empty plan that passes the policies.
+	Approver Approver
+	// Performed, if set, is called after every performed change, including the changes of nested parts.
+	// It tells which changes are done when the plan fails partway.
+	Performed func(c Change)
+}
+
+// Register adds policies to be evaluated by the executor.
+func (e *Executor) Register(policies ...Policy) {
+	e.Policies = append(e.Policies, policies...)
+}
+
+// Check evaluates all registered policies against the plan and returns the aggregated findings.
+// The returned error is a *PolicyError if any of the findings denies the plan.
+func (e *Executor) Check(ctx context.Context, p *Plan) ([]Finding, error) {
+	var (
+		findings []Finding
+		denied   bool
+	)
+	for _, policy := range e.Policies {
+		for _, f := range policy.Evaluate(ctx, p) {
+			findings = append(findings, f)
+			denied = denied || f.Severity == Deny
+		}
+	}
+	if denied {
+		return findings, &PolicyError{Findings: findings}
+	}
+	return findings, nil
+}
+
+// Apply validates the plan and performs it if no policy denies it and the Approver confirms it.
+// ErrNotApproved is returned if the plan is rejected by the Approver.
+func (e *Executor) Apply(ctx context.Context, p *Plan) error {
+	findings, err := e.Check(ctx, p)
+	if e.Report != nil {
+		for _, f := range findings {
+			e.Report(f)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if e.Approver != nil && !p.Empty() {
+		approved, err := e.Approver.Approve(ctx, p)
+		if err != nil {
+			return err
+		}
+		if !approved {
+			return ErrNotApproved
+		}
+	}
+	return p.do(ctx, e.Performed)
+}
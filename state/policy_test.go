@@ -0,0 +1,106 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecutor_Apply(t *testing.T) {
+	var performedActions recorder
+	prev := stateItems([]testInput{{"/Prod/1", "a"}, {"/Dev/1", "a"}}, &performedActions)
+	next := stateItems([]testInput{{"/Prod/1", "b"}, {"/Dev/1", "b"}}, &performedActions)
+
+	noProdUpdates := PolicyFunc(func(ctx context.Context, p *Plan) []Finding {
+		var res []Finding
+		_ = p.Walk(func(c Change) error {
+			if c.Op == OpUpdate && strings.HasPrefix(c.Id(), "/Prod/") {
+				res = append(res, Finding{Severity: Deny, Id: c.Id(), Message: "no updates in production"})
+			}
+			return nil
+		})
+		return res
+	})
+	warnAll := PolicyFunc(func(ctx context.Context, p *Plan) []Finding {
+		return []Finding{{Severity: Warn, Message: "changing stuff"}}
+	})
+
+	p, err := NewPlan(prev, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []string
+	e := &Executor{Report: func(f Finding) {
+		reported = append(reported, f.String())
+	}}
+	e.Register(warnAll, noProdUpdates)
+
+	err = e.Apply(context.TODO(), p)
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(policyErr.Findings) != 2 {
+		t.Errorf("Unexpected findings: %v", policyErr.Findings)
+	}
+	if err.Error() != "plan denied by policy: deny /Prod/1: no updates in production" {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+	wantReported := []string{"warn: changing stuff", "deny /Prod/1: no updates in production"}
+	if !reflect.DeepEqual(reported, wantReported) {
+		t.Errorf("Unexpected reported findings: got %v, want %v", reported, wantReported)
+	}
+	if len(performedActions) != 0 {
+		t.Errorf("Denied plan was performed: %v", performedActions)
+	}
+
+	// Warnings alone do not prevent the plan from running.
+	reported = nil
+	e.Policies = []Policy{warnAll}
+	var performed []string
+	e.Performed = func(c Change) {
+		performed = append(performed, c.Id())
+	}
+	if err := e.Apply(context.TODO(), p); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/Prod/1", "/Dev/1"}; !reflect.DeepEqual(performed, want) {
+		t.Errorf("Unexpected performed changes: got %v, want %v", performed, want)
+	}
+	want := recorder{"update /Prod/1 with b from /Prod/1/a", "update /Dev/1 with b from /Dev/1/a"}
+	if !reflect.DeepEqual(performedActions, want) {
+		t.Errorf("actions resulted in %v, want %v", performedActions, want)
+	}
+	if len(reported) != 1 {
+		t.Errorf("Unexpected reported findings: %v", reported)
+	}
+}
+
+func TestUpdateMethod(t *testing.T) {
+	items, err := BuildStateItems(makeTestStruct(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("Unexpected items: %v", items)
+	}
+	parts := items[0].(ComposedItem).Parts
+	methods := make(map[string]string)
+	for _, item := range parts {
+		methods[item.Id()] = UpdateMethod(item)
+	}
+	want := map[string]string{"/aa/Value": "Reset", "/aa/AnotherValue": "", "/aa/ActionableValue": ""}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("Unexpected update methods: got %v, want %v", methods, want)
+	}
+
+	if v, ok := Value(parts[0]); !ok || v != "v1" {
+		t.Errorf("Unexpected value of %s: %v", parts[0].Id(), v)
+	}
+	if v, ok := Value(items[0]); !ok || v.(testStateStruct).Id != "aa" {
+		t.Errorf("Unexpected value of %s: %#v", items[0].Id(), v)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
 )
 
 type valueStateItem struct {
@@ -12,6 +13,12 @@ type valueStateItem struct {
 	valueId *valueId
 	value   reflect.Value
 	parent  *valueStateItem
+
+	// Set if a change of the value requires the replacement of the parent item.
+	replace replaceMark
+
+	// Compares the values instead of reflect.DeepEqual if set.
+	cmp comparator
 }
 
 func (vsi valueStateItem) String() string {
@@ -22,24 +29,79 @@ func (vsi valueStateItem) Id() string {
 	return vsi.valueId.String()
 }
 
+// IsSame is called on the next item with the previous one, the same way NewPlan does it.
 func (vsi valueStateItem) IsSame(other Item) bool {
 	if aVsi, ok := other.(valueStateItem); ok {
-		return vsi.Id() == aVsi.Id() && reflect.DeepEqual(vsi.value.Interface(), aVsi.value.Interface())
+		return vsi.Id() == aVsi.Id() && sameValues(aVsi, vsi)
 	} else {
 		return false
 	}
 }
 
+// sameValues compares the values of the prev and next items with the comparator of the next item,
+// or with reflect.DeepEqual if it does not have one. The comparator is called with the prev and next values
+// in this order.
+func sameValues(prev, next valueStateItem) bool {
+	if next.cmp != nil {
+		return prev.value.IsValid() && next.value.IsValid() && next.cmp(prev.value, next.value)
+	}
+	return reflect.DeepEqual(prev.value.Interface(), next.value.Interface())
+}
+
+// Value returns the Go value the item was built from by BuildStateItems.
+func Value(item Item) (interface{}, bool) {
+	switch it := item.(type) {
+	case valueStateItem:
+		return it.value.Interface(), true
+	case ComposedItem:
+		return it.original, it.original != nil
+	default:
+		return nil, false
+	}
+}
+
+// UpdateMethod returns the name of the parent method bound to the item with the `state:"Method"` field tag.
+// It returns an empty string if the item is not updated with a parent method.
+func UpdateMethod(item Item) string {
+	var act Actionable
+	switch it := item.(type) {
+	case valueStateItem:
+		act = it.Actionable
+	case ComposedItem:
+		act = it.actions
+	}
+	if a, ok := act.(actions); ok {
+		return a.parentUpdateName
+	}
+	return ""
+}
+
 // BuildStateItems creates a state representation fom the input struct or slice.
+// It returns an error instead of panicking if the input cannot be represented.
+// Structs are identified by the values of the fields tagged with `state:"id"`, or by their StateId or Id methods.
+// Lists are compared regardless of the order of their elements unless the field is tagged with `state:"ordered"`,
+// or with `state:"Method,ordered"` to call the parent method with the previous list when the list changes.
+// Elements of the lists without IDs are identified by their indexes. Tag such a list with `state:"lcs"` to match
+// the elements by their content, so that inserting or deleting an element does not update the following ones.
 func BuildStateItems(input interface{}) ([]Item, error) {
 	v := reflect.ValueOf(input)
-	res, err := buildStateItem(v, &valueId{}, nil)
+	b := &builder{}
+	res, err := b.build(v, &valueId{}, nil)
 	if err != nil {
 		return nil, err
 	}
+	if err := b.validationError(); err != nil {
+		return nil, err
+	}
 	if cRes, ok := res.(ComposedItem); ok {
+		if err := checkDuplicateIds(cRes.Parts, cRes.Id()); err != nil {
+			return nil, err
+		}
+		cacheDigests(cRes.Parts)
 		if cRes.actions != nil && cRes.actions != noop {
-			return []Item{cRes}, nil
+			items := []Item{cRes}
+			cacheDigests(items)
+			return items, nil
 		}
 		return cRes.Parts, nil
 	}
@@ -51,44 +113,114 @@ type fieldContext struct {
 	target *reflect.Value
 }
 
-func buildStateItem(v reflect.Value, id *valueId, fctx *fieldContext) (Item, error) {
+// builder keeps the state of a BuildStateItems walk.
+type builder struct {
+	violations []violation
+
+	// Name of the comparator set with the tag of a list or map field for its elements.
+	// It is consumed by the next built element.
+	elementCmp string
+	// visited holds the pointers being built, so that cycles are reported instead of being followed forever.
+	visited map[uintptr]bool
+}
+
+// enter marks the pointer v as being built. It fails if v is already being built up the tree.
+// The returned function must be called when v is built.
+func (b *builder) enter(v reflect.Value, id *valueId) (func(), error) {
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return func() {}, nil
+	}
+	if b.visited == nil {
+		b.visited = make(map[uintptr]bool)
+	}
+	ptr := v.Pointer()
+	if b.visited[ptr] {
+		return nil, fmt.Errorf("%s: cyclic reference to %s", id, v.Type())
+	}
+	b.visited[ptr] = true
+	return func() { delete(b.visited, ptr) }, nil
+}
+
+func (b *builder) build(v reflect.Value, id *valueId, fctx *fieldContext) (Item, error) {
+	cmpName := b.elementCmp
+	b.elementCmp = ""
+	if fctx != nil {
+		tag, err := parseStateTag(fctx.field.Tag.Get("state"))
+		if err != nil {
+			return nil, fmt.Errorf("bad state tag of %s: %w", fctx.field.Name, err)
+		}
+		cmpName = tag.value(optionCmp)
+	}
+
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		// Methods are resolved on the dynamic value.
+		v = v.Elem()
+	}
 	origValue := v
 	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		leave, err := b.enter(v, id)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
 		// Unwrap first.
 		v = v.Elem()
 	}
 
-	switch v.Kind() {
-	case reflect.Ptr, reflect.Interface:
-		panic("state: value is not unwrapped: " + v.String())
+	if !v.IsValid() {
+		// Nil pointers and interfaces are not represented in the state.
+		return nil, nil
+	}
+	elementCmp := ""
+	if cmpName != "" && !namedComparatorAccepts(cmpName, v.Type()) && elementsAccepted(cmpName, v.Type()) {
+		// The comparator of the list or map field compares its elements.
+		elementCmp, cmpName = cmpName, ""
+	}
+	if item, err := b.comparedItem(v, origValue, id, fctx, cmpName); item != nil || err != nil {
+		return item, err
+	}
 
+	switch v.Kind() {
 	case reflect.Slice, reflect.Array:
-		parts := make([]Item, v.Len())
-		for i := range parts {
-			var err error
-			parts[i], err = buildStateItem(v.Index(i), id.nextListId(i), nil)
+		parts := make([]Item, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			b.elementCmp = elementCmp
+			part, err := b.build(v.Index(i), id.nextListId(i), nil)
 			if err != nil {
 				return nil, err
 			}
+			if part != nil {
+				parts = append(parts, part)
+			}
 		}
-		return ComposedItem{id, parts, nil, nil}, nil
+		return listItem(ComposedItem{IdValue: id, Parts: parts, valueType: v.Type()}, v, fctx)
 
 	case reflect.Map:
-		parts := make([]Item, v.Len())
-		i := 0
-		iter := v.MapRange()
-		for iter.Next() {
-			var err error
-			parts[i], err = buildStateItem(iter.Value(), id.next(iter.Key().String()), nil)
+		keys, err := mapKeys(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		parts := make([]Item, 0, len(keys))
+		for _, k := range keys {
+			b.elementCmp = elementCmp
+			part, err := b.build(v.MapIndex(k.value), id.next(k.id), nil)
 			if err != nil {
 				return nil, err
 			}
-			i++
+			if part != nil {
+				parts = append(parts, part)
+			}
 		}
-		return ComposedItem{id, parts, nil, nil}, nil
+		return ComposedItem{IdValue: id, Parts: parts, valueType: v.Type()}, nil
 
 	case reflect.Struct:
 		parts := make([]Item, 0, v.NumField())
+		if structId, ok := structId(v); ok {
+			var err error
+			if id, err = id.inject(structId); err != nil {
+				return nil, err
+			}
+		}
 		for i := 0; i < v.NumField(); i++ {
 			field := v.Type().Field(i)
 			// Skip unexported fields.
@@ -96,18 +228,34 @@ func buildStateItem(v reflect.Value, id *valueId, fctx *fieldContext) (Item, err
 				continue
 			}
 
-			tag := field.Tag.Get("state")
-			if tag == "-" {
+			fieldId := id.next(field.Name)
+			if err := b.validate(v.Field(i), field, fieldId); err != nil {
+				return nil, err
+			}
+
+			tag, err := parseStateTag(field.Tag.Get("state"))
+			if err != nil {
+				return nil, fmt.Errorf("bad state tag of %s: %w", field.Name, err)
+			}
+			if tag.name == tagSkip {
 				continue
 			}
-			if tag == "id" {
-				id = id.inject(fmt.Sprintf("%s", v.Field(i)))
+			if tag.ordered() && !isList(field.Type) {
+				return nil, fmt.Errorf("ordered field %s is not a slice or an array", field.Name)
+			}
+			if tag.name == tagLcs && !isList(field.Type) {
+				return nil, fmt.Errorf("lcs field %s is not a slice or an array", field.Name)
+			}
+			if tag.name == tagId {
 				continue
 			}
 
-			if part, err := buildStateItem(v.Field(i), id.next(field.Name), &fieldContext{field: &field, target: &origValue}); err != nil {
+			if part, err := b.build(v.Field(i), fieldId, &fieldContext{field: &field, target: &origValue}); err != nil {
 				return nil, err
-			} else {
+			} else if part != nil {
+				if tag.name == tagReplace {
+					part = markReplace(part, tag.replaceMark())
+				}
 				parts = append(parts, part)
 			}
 		}
@@ -118,7 +266,19 @@ func buildStateItem(v reflect.Value, id *valueId, fctx *fieldContext) (Item, err
 		if act == noop {
 			act = nil
 		}
-		return ComposedItem{id, parts, act, v.Interface()}, nil
+		res := ComposedItem{IdValue: id, Parts: parts, actions: act, original: v.Interface(), valueType: v.Type()}
+		for _, target := range []reflect.Value{origValue, v} {
+			if r, ok := target.Interface().(Replacer); ok && res.replacer == nil {
+				res.replacer = r
+			}
+			if s, ok := target.Interface().(ReplaceStrategySelector); ok && res.strategy == nil {
+				res.strategy = s
+			}
+			if r, ok := target.Interface().(Renamer); ok && res.renamer == nil {
+				res.renamer = r
+			}
+		}
+		return res, nil
 
 	default:
 		act, err := buildActionable(v, fctx)
@@ -133,6 +293,167 @@ func buildStateItem(v reflect.Value, id *valueId, fctx *fieldContext) (Item, err
 	}
 }
 
+// idMethods lists the methods BuildStateItems gets the struct IDs from, in the order of precedence.
+// The fields tagged with `state:"id"` take precedence over the methods.
+var idMethods = []string{"StateId", "Id"}
+
+var itemInterface = reflect.TypeOf((*Item)(nil)).Elem()
+
+// StructId returns the ID segment BuildStateItems gives to the struct value v, or to the struct v points to.
+// It returns false if the struct is not identified with the `state:"id"` fields or the ID methods.
+func StructId(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return "", false
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return "", false
+	}
+	return structId(rv)
+}
+
+// IdFields returns the indexes of the struct fields tagged with `state:"id"`.
+func IdFields(t reflect.Type) []int {
+	var res []int
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if tag, err := parseStateTag(field.Tag.Get("state")); err == nil && tag.name == tagId {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// IdMethod returns the name of the method the ID of the struct type is returned by, the StateId or Id method with
+// the func() string signature, declared with a value or a pointer receiver.
+// It returns an empty string if the type has fields tagged with `state:"id"`, or if it implements Item, as items
+// keep their path IDs.
+func IdMethod(t reflect.Type) string {
+	if len(IdFields(t)) > 0 || t.Implements(itemInterface) || reflect.PtrTo(t).Implements(itemInterface) {
+		return ""
+	}
+	for _, name := range idMethods {
+		for _, target := range []reflect.Type{t, reflect.PtrTo(t)} {
+			m, present := target.MethodByName(name)
+			if !present {
+				continue
+			}
+			// The receiver is the first argument.
+			if mt := m.Type; mt.NumIn() == 1 && mt.NumOut() == 1 && mt.Out(0).Kind() == reflect.String {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// structId returns the ID of the struct value. Values of the fields tagged with `state:"id"` are escaped the same
+// way the Path segments are, and joined with a slash into a single ID segment, so that different values do not
+// collide. Without such fields, the ID is returned by the IdMethod.
+func structId(v reflect.Value) (string, bool) {
+	if fields := IdFields(v.Type()); len(fields) > 0 {
+		values := make([]string, len(fields))
+		for i, index := range fields {
+			values[i] = fmt.Sprint(v.Field(index))
+		}
+		if len(values) == 1 {
+			return values[0], true
+		}
+		for i := range values {
+			values[i] = escapeSegment(values[i])
+		}
+		return strings.Join(values, "/"), true
+	}
+
+	name := IdMethod(v.Type())
+	if name == "" {
+		return "", false
+	}
+	m := v.MethodByName(name)
+	if !m.IsValid() {
+		// Declared with a pointer receiver.
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		if v.CanAddr() {
+			ptr = v.Addr()
+		}
+		m = ptr.MethodByName(name)
+	}
+	return m.Call(nil)[0].String(), true
+}
+
+// comparedItem returns the item of the value compared with a custom comparator as a whole.
+// It returns nil if the value does not have a comparator.
+// The comparator named with cmpName takes precedence over the comparator of the value type.
+func (b *builder) comparedItem(v reflect.Value, origValue reflect.Value, id *valueId, fctx *fieldContext, cmpName string) (Item, error) {
+	cmp, err := comparatorOf(v, cmpName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	if cmp == nil {
+		return nil, nil
+	}
+	var act Actionable
+	if v.Kind() == reflect.Struct {
+		// The struct is identified and validated as if it was split into the parts.
+		if structId, ok := structId(v); ok {
+			if id, err = id.inject(structId); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.validateFields(v, id); err != nil {
+			return nil, err
+		}
+		act, err = structActionable(v, origValue, fctx)
+	} else {
+		act, err = buildActionable(v, fctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return valueStateItem{Actionable: act, valueId: id, value: v, cmp: cmp}, nil
+}
+
+// listItem applies the tag of the list field to the list item.
+// The `state:"lcs"` tag makes the list parts matched by their content when the list is changed.
+// The `state:"ordered"` tag makes the order of the list parts significant, the parent method set with the tag name
+// is called with the previous list when the list is changed.
+func listItem(res ComposedItem, v reflect.Value, fctx *fieldContext) (Item, error) {
+	if fctx == nil {
+		return res, nil
+	}
+	tag, _ := parseStateTag(fctx.field.Tag.Get("state"))
+	res.lcs = tag.name == tagLcs
+	if !tag.ordered() {
+		return res, nil
+	}
+	res.ordered = true
+	if name := updateMethodName(tag.name); name != "" {
+		update, err := updateActionWithMethod(*fctx.target, name)
+		if err != nil {
+			return nil, err
+		}
+		if update != nil {
+			res.actions = actions{parentUpdate: update, parentUpdateName: name}
+			res.original = v.Interface()
+		}
+	}
+	return res, nil
+}
+
+func isList(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+}
+
 func structActionable(v reflect.Value, origValue reflect.Value, fctx *fieldContext) (Actionable, error) {
 	var (
 		act Actionable
@@ -154,13 +475,15 @@ func structActionable(v reflect.Value, origValue reflect.Value, fctx *fieldConte
 var actionFuncType = reflect.TypeOf(ActionFunc(nil))
 var updateActionFuncType = reflect.TypeOf(updateActionFunc(nil))
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
 func resolveMethod(target reflect.Value, name string, methodType reflect.Type) (reflect.Value, bool, error) {
 	m := target.MethodByName(name)
 	if m.Kind() == reflect.Invalid {
 		return m, false, nil
 	}
 	t := m.Type()
-	if t.NumIn() != methodType.NumIn() || t.In(0) != methodType.In(0) {
+	if t.NumIn() != methodType.NumIn() || t.In(0) != methodType.In(0) || t.NumOut() != 1 || t.Out(0) != errorType {
 		return m, true, fmt.Errorf("bad action method signature %s, expected %s", t, methodType)
 	}
 	return m, true, nil
@@ -185,11 +508,17 @@ func updateActionWithMethod(target reflect.Value, name string) (updateActionFunc
 	if !present || err != nil {
 		return nil, err
 	}
+	argType := m.Type().In(1)
 	return func(ctx context.Context, prev interface{}) error {
 		prevArg := reflect.ValueOf(prev)
 		if vsi, ok := prev.(valueStateItem); ok {
 			prevArg = vsi.value
 		}
+		if !prevArg.IsValid() {
+			prevArg = reflect.Zero(argType)
+		} else if !prevArg.Type().AssignableTo(argType) {
+			return fmt.Errorf("cannot call %s with the previous value of type %s", name, prevArg.Type())
+		}
 		res := m.Call([]reflect.Value{reflect.ValueOf(ctx), prevArg})
 		if res[0].IsNil() {
 			return nil
@@ -232,14 +561,15 @@ func buildActionable(target reflect.Value, fctx *fieldContext) (Actionable, erro
 
 	parentUpdateMethod := ""
 	if fctx != nil {
-		parentUpdateMethod = fctx.field.Tag.Get("state")
-		if parentUpdateMethod == "-" || parentUpdateMethod == "id" {
-			parentUpdateMethod = ""
-		}
+		tag, _ := parseStateTag(fctx.field.Tag.Get("state"))
+		parentUpdateMethod = updateMethodName(tag.name)
 	}
 
 	if parentUpdateMethod != "" {
 		res.parentUpdate, err = updateActionWithMethod(*fctx.target, parentUpdateMethod)
+		if res.parentUpdate != nil {
+			res.parentUpdateName = parentUpdateMethod
+		}
 	}
 
 	if res.isWrapperOnly() {
@@ -3,6 +3,7 @@ package state
 import (
 	"context"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -91,8 +92,8 @@ func TestBuildStateItems(t *testing.T) {
 			name:  "slice of structs",
 			input: []interface{}{&testStruct, &testStruct},
 			want: []Item{
-				ComposedItem{StringId("/0"), prefixedStructState("/0"), nil, nil},
-				ComposedItem{StringId("/1"), prefixedStructState("/1"), nil, nil},
+				ComposedItem{IdValue: StringId("/0"), Parts: prefixedStructState("/0")},
+				ComposedItem{IdValue: StringId("/1"), Parts: prefixedStructState("/1")},
 			},
 			wantErr: false,
 		},
@@ -100,7 +101,7 @@ func TestBuildStateItems(t *testing.T) {
 			name:  "struct with struct",
 			input: &wrappingStruct,
 			want: []Item{
-				ComposedItem{StringId("/Data"), prefixedStructState("/Data"), nil, nil},
+				ComposedItem{IdValue: StringId("/Data"), Parts: prefixedStructState("/Data")},
 			},
 			wantErr: false,
 		},
@@ -154,6 +155,103 @@ func TestBuildStateItems_IdTag(t *testing.T) {
 	}
 }
 
+type server struct {
+	Region string `state:"id"`
+	Name   string `state:"id"`
+	Size   int
+}
+
+type valueKey struct{ Name, Zone string }
+
+func (vk valueKey) Id() string { return vk.Zone + "-" + vk.Name }
+
+type pointerKey struct{ Name string }
+
+func (pk *pointerKey) StateId() string { return "key-" + pk.Name }
+
+func (pk *pointerKey) Id() string { return "ignored" }
+
+type badKey struct{ Name string }
+
+func (bk badKey) Id() int { return 42 }
+
+func TestBuildStateItems_IdSources(t *testing.T) {
+	tests := []struct {
+		name  string
+		input interface{}
+		want  []string
+	}{
+		{
+			name:  "composite",
+			input: []server{{Region: "eu", Name: "web", Size: 1}},
+			want:  []string{"/eu~1web", "/eu~1web/Size"},
+		},
+		{
+			name:  "composite escaped",
+			input: []server{{Region: "a/b", Name: "c"}, {Region: "a", Name: "b/c"}},
+			want:  []string{"/a~01b~1c", "/a~01b~1c/Size", "/a~1b~01c", "/a~1b~01c/Size"},
+		},
+		{
+			name:  "value method",
+			input: map[string]valueKey{"a": {Name: "n", Zone: "z"}},
+			want:  []string{"/a/z-n", "/a/z-n/Name", "/a/z-n/Zone"},
+		},
+		{
+			name:  "pointer method on pointers",
+			input: []*pointerKey{{Name: "n"}},
+			want:  []string{"/key-n", "/key-n/Name"},
+		},
+		{
+			name:  "pointer method on values",
+			input: [1]pointerKey{{Name: "n"}},
+			want:  []string{"/key-n", "/key-n/Name"},
+		},
+		{
+			name:  "bad method",
+			input: []badKey{{Name: "n"}},
+			want:  []string{"/0", "/0/Name"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := BuildStateItems(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, item := range items {
+				ids = append(ids, item.Id())
+				for _, part := range item.(ComposedItem).Parts {
+					ids = append(ids, part.Id())
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Unexpected IDs: got %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructId(t *testing.T) {
+	for _, tt := range []struct {
+		value interface{}
+		id    string
+		ok    bool
+	}{
+		{server{Region: "eu", Name: "web"}, "eu/web", true},
+		{&pointerKey{Name: "n"}, "key-n", true},
+		{pointerKey{Name: "n"}, "key-n", true},
+		{badKey{}, "", false},
+		{testStateItem{id: "a"}, "", false},
+		{(*server)(nil), "", false},
+		{"string", "", false},
+	} {
+		if id, ok := StructId(tt.value); id != tt.id || ok != tt.ok {
+			t.Errorf("Unexpected ID of %#v: %q, %t", tt.value, id, ok)
+		}
+	}
+}
+
 func assureNoErrors(t *testing.T, act Actionable, updateArg interface{}) {
 	if err := act.Create(context.TODO()); err != nil {
 		t.Error("Unexpected error on create", err)
@@ -312,3 +410,128 @@ func makeTestStruct(recorder *recorder) *testStateStruct {
 		},
 	}
 }
+
+func TestBuildStateItems_NoPanics(t *testing.T) {
+	type space struct{ Area int }
+	type room struct {
+		Name  string `state:"id"`
+		Space *space
+	}
+	items, err := BuildStateItems([]*room{{Name: "a"}, nil, {Name: "b", Space: &space{Area: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.Id())
+		for _, part := range item.(ComposedItem).Parts {
+			ids = append(ids, part.Id())
+		}
+	}
+	if want := []string{"/a", "/b", "/b/Space"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Unexpected IDs: got %v, want %v", ids, want)
+	}
+
+	if _, err := BuildStateItems(nil); err == nil {
+		t.Error("No error for nil input")
+	}
+
+	type node struct {
+		Name string
+		Next *node
+	}
+	n := &node{Name: "a"}
+	n.Next = &node{Name: "b", Next: n}
+	if _, err := BuildStateItems(n); err == nil || !strings.Contains(err.Error(), "cyclic reference") {
+		t.Errorf("Unexpected error for a cycle: %v", err)
+	}
+	// Shared pointers are not cycles.
+	shared := &node{Name: "c"}
+	if _, err := BuildStateItems([]*node{{Name: "a", Next: shared}, {Name: "b", Next: shared}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBuildStateItems_BadStateTag(t *testing.T) {
+	_, err := BuildStateItems([]struct {
+		A string `state:"Update,create-before-remove"`
+	}{{}})
+	if err == nil || err.Error() != `bad state tag of A: unknown option "create-before-remove" of "Update"` {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+type middleware struct {
+	Name string `state:"id"`
+}
+
+type chain struct {
+	Middleware []*middleware `state:"Reorder,ordered"`
+	Unordered  []*middleware
+	r          *recorder
+}
+
+func names(list []*middleware) string {
+	res := make([]string, len(list))
+	for i, m := range list {
+		res[i] = m.Name
+	}
+	return strings.Join(res, ",")
+}
+
+func (c *chain) Reorder(ctx context.Context, prev []*middleware) error {
+	c.r.record("reorder " + names(prev) + " to " + names(c.Middleware))
+	return nil
+}
+
+func TestBuildStateItems_Ordered(t *testing.T) {
+	r := new(recorder)
+	build := func(ordered, unordered []string) Set {
+		c := &chain{r: r}
+		for _, name := range ordered {
+			c.Middleware = append(c.Middleware, &middleware{Name: name})
+		}
+		for _, name := range unordered {
+			c.Unordered = append(c.Unordered, &middleware{Name: name})
+		}
+		items, err := BuildStateItems(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	if HashSet(build([]string{"a", "b"}, nil)) == HashSet(build([]string{"b", "a"}, nil)) {
+		t.Error("Order of the ordered list does not change the hash")
+	}
+	p, err := NewPlan(build([]string{"a", "b", "c"}, nil), build([]string{"c", "a", "b"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "  ~ /Middleware (Reorder)\nPlan: 0 to create, 1 to update, 0 to remove.\n"; p.String() != want {
+		t.Errorf("Unexpected plan:\n%s", p)
+	}
+	if err := p.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (recorder{"reorder a,b,c to c,a,b"}); !reflect.DeepEqual(*r, want) {
+		t.Errorf("Unexpected actions: %v", *r)
+	}
+
+	if p, err := NewPlan(build(nil, []string{"a", "b"}), build(nil, []string{"b", "a"})); err != nil || !p.Empty() {
+		t.Errorf("Order of the unordered list is significant: %v\n%s", err, p)
+	}
+
+	type badOrder struct {
+		A string `state:"ordered"`
+	}
+	if _, err := BuildStateItems(badOrder{}); err == nil || err.Error() != "ordered field A is not a slice or an array" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	type badOption struct {
+		A []string `state:"id,ordered"`
+	}
+	if _, err := BuildStateItems(badOption{}); err == nil || !strings.Contains(err.Error(), `unknown option "ordered" of "id"`) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Metadata describes a registered resource type.
+type Metadata struct {
+	Description string
+	// Fields holds the descriptions of the struct fields by their Go names.
+	Fields map[string]string
+}
+
+// ResourceType is a Go struct type registered under a type name.
+type ResourceType struct {
+	Name     string
+	Type     reflect.Type
+	Metadata Metadata
+}
+
+// New returns a pointer to a new zero value of the resource type.
+func (rt *ResourceType) New() interface{} {
+	return reflect.New(rt.Type).Interface()
+}
+
+// Registry maps type names to resource types, so that the desired state can be instantiated from type names
+// found in data files.
+type Registry struct {
+	mu    sync.RWMutex
+	types map[string]*ResourceType
+}
+
+func NewRegistry() *Registry {
+	return &Registry{types: make(map[string]*ResourceType)}
+}
+
+// DefaultRegistry is the registry used by the package-level Register function.
+var DefaultRegistry = NewRegistry()
+
+// Register registers the resource type in the DefaultRegistry. It panics if the type cannot be registered.
+// It is meant to be called from the init functions of the packages implementing the resources.
+func Register(name string, prototype interface{}, meta Metadata) {
+	if err := DefaultRegistry.Register(name, prototype, meta); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds the type of the prototype value, a struct or a pointer to a struct, under the given name.
+// Create, Remove, Update methods and update methods referenced with the `state:"Method"` field tags are checked
+// the same way BuildStateItems does it, so that types with bad method signatures are rejected at registration.
+func (r *Registry) Register(name string, prototype interface{}, meta Metadata) error {
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		return fmt.Errorf("cannot register %s: prototype is nil", name)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot register %s: %s is not a struct", name, t)
+	}
+	if err := checkMethods(t, make(map[reflect.Type]bool)); err != nil {
+		return fmt.Errorf("cannot register %s: %w", name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if registered, present := r.types[name]; present {
+		return fmt.Errorf("cannot register %s: name is already used by %s", name, registered.Type)
+	}
+	r.types[name] = &ResourceType{Name: name, Type: t, Metadata: meta}
+	return nil
+}
+
+// Lookup returns the resource type registered under the name.
+func (r *Registry) Lookup(name string) (*ResourceType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rt, ok := r.types[name]
+	return rt, ok
+}
+
+// Names returns the sorted names of the registered resource types.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]string, 0, len(r.types))
+	for name := range r.types {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// checkMethods resolves the action methods of the type and the types of its fields.
+func checkMethods(t reflect.Type, visited map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visited[t] {
+		return nil
+	}
+	visited[t] = true
+
+	ptr := reflect.New(t)
+	for _, target := range []reflect.Value{ptr, ptr.Elem()} {
+		if _, ok := target.Interface().(Actionable); ok {
+			continue
+		}
+		for _, name := range []string{"Create", "Remove"} {
+			if _, err := actionWithMethod(target, name); err != nil {
+				return fmt.Errorf("%s.%s: %w", target.Type(), name, err)
+			}
+		}
+		if _, err := updateActionWithMethod(target, "Update"); err != nil {
+			return fmt.Errorf("%s.Update: %w", target.Type(), err)
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag, err := parseStateTag(field.Tag.Get("state"))
+		if err != nil {
+			return fmt.Errorf("%s: bad state tag of %s: %w", t, field.Name, err)
+		}
+		if tag.name == tagSkip {
+			continue
+		}
+		if name := updateMethodName(tag.name); name != "" {
+			if _, err := updateActionWithMethod(ptr, name); err != nil {
+				return fmt.Errorf("%s.%s (update method of %s): %w", t, name, field.Name, err)
+			}
+		}
+		if err := checkMethods(field.Type, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
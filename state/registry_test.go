@@ -0,0 +1,85 @@
+package state
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type badCreate struct{}
+
+func (bc badCreate) Create(name string) error { return nil }
+
+type noResultCreate struct{}
+
+func (nrc *noResultCreate) Create(ctx context.Context) {}
+
+type badUpdateTag struct {
+	Value string `state:"Change"`
+}
+
+func (but *badUpdateTag) Change(prev string) error { return nil }
+
+type nestedBad struct {
+	Items []*badCreate
+}
+
+type goodUpdateTag struct {
+	Value string `state:"Change"`
+}
+
+func (gut *goodUpdateTag) Change(ctx context.Context, prev string) error { return nil }
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register("Struct", &testStateStruct{}, Metadata{Description: "test struct"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("Good", goodUpdateTag{}, Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		prototype interface{}
+		wantErr   string
+	}{
+		{name: "Struct", prototype: &testStateStruct{}, wantErr: "name is already used"},
+		{name: "String", prototype: "abc", wantErr: "string is not a struct"},
+		{name: "Nil", prototype: nil, wantErr: "prototype is nil"},
+		{name: "BadCreate", prototype: badCreate{}, wantErr: "bad action method signature"},
+		{name: "NoResultCreate", prototype: noResultCreate{}, wantErr: "bad action method signature"},
+		{name: "BadUpdateTag", prototype: badUpdateTag{}, wantErr: "update method of Value"},
+		{name: "NestedBad", prototype: nestedBad{}, wantErr: "state.badCreate.Create"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Register(tt.name, tt.prototype, Metadata{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := BuildStateItems(&noResultCreate{}); err == nil || !strings.Contains(err.Error(), "bad action method signature") {
+		t.Errorf("Unexpected error of building the item without the action result: %v", err)
+	}
+
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"Good", "Struct"}) {
+		t.Errorf("Unexpected names: %v", names)
+	}
+	rt, ok := r.Lookup("Struct")
+	if !ok {
+		t.Fatal("Registered type is not found")
+	}
+	if rt.Metadata.Description != "test struct" {
+		t.Errorf("Unexpected metadata: %v", rt.Metadata)
+	}
+	if _, ok := rt.New().(*testStateStruct); !ok {
+		t.Errorf("Unexpected new value: %#v", rt.New())
+	}
+	if _, ok := r.Lookup("Missing"); ok {
+		t.Error("Unknown type is found")
+	}
+}
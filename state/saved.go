@@ -0,0 +1,130 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStalePlan is returned when a saved plan is applied to the state it was not computed from.
+var ErrStalePlan = errors.New("saved plan is stale")
+
+// SavedPlan is a serializable form of a Plan.
+// It can be stored, reviewed, and bound to the live state items later with Bind.
+type SavedPlan struct {
+	// PrevDigest and NextDigest are content hashes of the Sets the plan was computed from.
+	PrevDigest string        `json:"prev"`
+	NextDigest string        `json:"next"`
+	Changes    []SavedChange `json:"changes"`
+}
+
+// SavedChange is a serializable form of a Change.
+type SavedChange struct {
+	Op       Op              `json:"op"`
+	Id       string          `json:"id"`
+	Parts    []SavedChange   `json:"parts,omitempty"`
+	Strategy ReplaceStrategy `json:"strategy,omitempty"`
+	// From is the previous ID of the moved item, it is empty if the ID does not change.
+	From string `json:"from,omitempty"`
+}
+
+func (op Op) MarshalText() ([]byte, error) {
+	switch op {
+	case OpCreate, OpUpdate, OpRemove, OpReplace, OpMove:
+		return []byte(op.String()), nil
+	default:
+		return nil, fmt.Errorf("unknown operation %d", int(op))
+	}
+}
+
+func (op *Op) UnmarshalText(text []byte) error {
+	for _, known := range []Op{OpCreate, OpUpdate, OpRemove, OpReplace, OpMove} {
+		if known.String() == string(text) {
+			*op = known
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operation %q", text)
+}
+
+// Save returns the serializable form of the plan.
+func (p *Plan) Save() *SavedPlan {
+	return &SavedPlan{
+		PrevDigest: HashSet(p.prev),
+		NextDigest: HashSet(p.next),
+		Changes:    saveChanges(p.Changes),
+	}
+}
+
+func saveChanges(changes []Change) []SavedChange {
+	if len(changes) == 0 {
+		return nil
+	}
+	res := make([]SavedChange, len(changes))
+	for i, c := range changes {
+		res[i] = SavedChange{Op: c.Op, Id: c.Id(), Parts: saveChanges(c.Parts), Strategy: c.Strategy}
+		if c.Before != nil && c.After != nil && c.Before.Id() != c.After.Id() {
+			res[i].From = c.Before.Id()
+		}
+	}
+	return res
+}
+
+// Bind restores the plan using the live items of the prev and next Sets.
+// It fails with ErrStalePlan if any of the Sets differs from the ones the plan was computed from.
+func (sp *SavedPlan) Bind(prev, next Set) (*Plan, error) {
+	if digest := HashSet(prev); digest != sp.PrevDigest {
+		return nil, fmt.Errorf("%w: previous state digest is %s, plan was computed for %s", ErrStalePlan, digest, sp.PrevDigest)
+	}
+	if digest := HashSet(next); digest != sp.NextDigest {
+		return nil, fmt.Errorf("%w: next state digest is %s, plan was computed for %s", ErrStalePlan, digest, sp.NextDigest)
+	}
+	if err := checkSet(prev); err != nil {
+		return nil, fmt.Errorf("previous state: %w", err)
+	}
+	if err := checkSet(next); err != nil {
+		return nil, fmt.Errorf("next state: %w", err)
+	}
+	changes, err := bindChanges(sp.Changes, prev, next)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{Changes: changes, prev: prev, next: next}, nil
+}
+
+func bindChanges(saved []SavedChange, prev, next []Item) ([]Change, error) {
+	if len(saved) == 0 {
+		return nil, nil
+	}
+	prevState, nextState := mapState(prev), mapState(next)
+	res := make([]Change, len(saved))
+	for i, sc := range saved {
+		c := Change{Op: sc.Op, Strategy: sc.Strategy}
+		if sc.Op == OpUpdate || sc.Op == OpRemove || sc.Op == OpReplace || sc.Op == OpMove {
+			from := sc.Id
+			if sc.From != "" {
+				from = sc.From
+			}
+			if c.Before = prevState[from]; c.Before == nil {
+				return nil, fmt.Errorf("cannot bind %s: %s is not found in the previous state", sc.Op, from)
+			}
+		}
+		if sc.Op == OpUpdate || sc.Op == OpCreate || sc.Op == OpReplace || sc.Op == OpMove {
+			if c.After = nextState[sc.Id]; c.After == nil {
+				return nil, fmt.Errorf("cannot bind %s: %s is not found in the next state", sc.Op, sc.Id)
+			}
+		}
+		if len(sc.Parts) > 0 {
+			before, beforeComposed := c.Before.(ComposedItem)
+			after, afterComposed := c.After.(ComposedItem)
+			if !beforeComposed || !afterComposed {
+				return nil, fmt.Errorf("cannot bind parts of %s: it is not a ComposedItem", sc.Id)
+			}
+			var err error
+			if c.Parts, err = bindChanges(sc.Parts, before.Parts, after.Parts); err != nil {
+				return nil, err
+			}
+		}
+		res[i] = c
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSavedPlan(t *testing.T) {
+	build := func(recording *recorder, value string) Set {
+		v := makeTestStruct(recording)
+		v.Value = value
+		items, err := BuildStateItems(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	var planRecording recorder
+	p, err := NewPlan(build(&planRecording, "v1"), build(&planRecording, "v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(p.Save())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved SavedPlan
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	wantChanges := []SavedChange{
+		{Op: OpUpdate, Id: "/aa", Parts: []SavedChange{{Op: OpUpdate, Id: "/aa/Value"}}},
+	}
+	if !reflect.DeepEqual(saved.Changes, wantChanges) {
+		t.Errorf("Unexpected saved changes: got %v, want %v", saved.Changes, wantChanges)
+	}
+
+	// Bind to the live items built again.
+	var recording recorder
+	bound, err := saved.Bind(build(&recording, "v1"), build(&recording, "v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bound.Do(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	want := recorder{"change testStateStruct value from v1 to v2"}
+	if !reflect.DeepEqual(recording, want) {
+		t.Errorf("Unexpected actions result: got %s, want %s", recording, want)
+	}
+
+	// The state has changed since the plan was computed.
+	recording = nil
+	if _, err := saved.Bind(build(&recording, "v0"), build(&recording, "v2")); !errors.Is(err, ErrStalePlan) {
+		t.Errorf("Unexpected error for stale previous state: %v", err)
+	}
+	if _, err := saved.Bind(build(&recording, "v1"), build(&recording, "v3")); !errors.Is(err, ErrStalePlan) {
+		t.Errorf("Unexpected error for stale next state: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package state
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SchemaDraft is the JSON Schema version of the generated schemas.
+const SchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// Schema is a JSON Schema document describing the JSON representation of a state type.
+type Schema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Ref         string `json:"$ref,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+	// AdditionalProperties is either a *Schema or false.
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	Items                *Schema     `json:"items,omitempty"`
+	OneOf                []*Schema   `json:"oneOf,omitempty"`
+
+	Const   interface{}   `json:"const,omitempty"`
+	Enum    []interface{} `json:"enum,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+	Minimum *float64      `json:"minimum,omitempty"`
+	Maximum *float64      `json:"maximum,omitempty"`
+
+	MinLength     *int `json:"minLength,omitempty"`
+	MaxLength     *int `json:"maxLength,omitempty"`
+	MinItems      *int `json:"minItems,omitempty"`
+	MaxItems      *int `json:"maxItems,omitempty"`
+	MinProperties *int `json:"minProperties,omitempty"`
+	MaxProperties *int `json:"maxProperties,omitempty"`
+
+	// StateId names the property marked with the `state:"id"` tag, which identifies the objects in lists.
+	// Several properties forming a composite ID are separated with commas.
+	StateId string `json:"x-state-id,omitempty"`
+	// StateIdMethod names the method returning the ID of the objects, if they are not identified with properties.
+	StateIdMethod string `json:"x-state-id-method,omitempty"`
+
+	Definitions map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// JSONSchema generates the schema of the JSON documents decoded into the values of type t.
+// It follows the rules of BuildStateItems: unexported fields and fields tagged with `state:"-"` are skipped,
+// and the `state:"id"` field is required and named with the x-state-id keyword.
+// Property names, embedded structs and omitted fields follow the encoding/json rules, and the `validate`
+// field tags are translated to the corresponding keywords.
+// Recursive types are described in the definitions of the returned schema, keyed by the package path and the
+// type name.
+func JSONSchema(t reflect.Type) (*Schema, error) {
+	g := &schemaGenerator{inProgress: make(map[reflect.Type]bool), definitions: make(map[string]*Schema)}
+	res, err := g.generate(t)
+	if err != nil {
+		return nil, err
+	}
+	for name, def := range g.definitions {
+		if def == res {
+			// Avoid a cycle when the root type is recursive.
+			rootCopy := *res
+			g.definitions[name] = &rootCopy
+		}
+	}
+	res.Schema = SchemaDraft
+	if len(g.definitions) > 0 {
+		res.Definitions = g.definitions
+	}
+	return res, nil
+}
+
+// JSONSchema generates the schema of the resource type with the descriptions from its metadata.
+func (rt *ResourceType) JSONSchema() (*Schema, error) {
+	res, err := JSONSchema(rt.Type)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate schema of %s: %w", rt.Name, err)
+	}
+	res.Title = rt.Name
+	res.Description = rt.Metadata.Description
+	for name, description := range rt.Metadata.Fields {
+		for i := 0; i < rt.Type.NumField(); i++ {
+			field := rt.Type.Field(i)
+			if field.Name != name {
+				continue
+			}
+			if prop := res.Properties[jsonFieldName(field)]; prop != nil {
+				prop.Description = description
+			}
+		}
+	}
+	return res, nil
+}
+
+type schemaGenerator struct {
+	inProgress  map[reflect.Type]bool
+	definitions map[string]*Schema
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+func (g *schemaGenerator) generate(t reflect.Type) (*Schema, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return &Schema{Type: "string"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Interface:
+		return &Schema{}, nil
+
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// Encoded with base64.
+			return &Schema{Type: "string"}, nil
+		}
+		items, err := g.generate(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+
+	case reflect.Map:
+		values, err := g.generate(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+
+	case reflect.Struct:
+		if g.inProgress[t] {
+			name := definitionName(t)
+			if _, present := g.definitions[name]; !present {
+				// Filled when the type is generated.
+				g.definitions[name] = nil
+			}
+			return &Schema{Ref: "#/definitions/" + escapeSegment(name)}, nil
+		}
+		g.inProgress[t] = true
+		defer delete(g.inProgress, t)
+
+		res := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+		if err := g.addFields(res, t); err != nil {
+			return nil, err
+		}
+		res.StateIdMethod = IdMethod(t)
+		sort.Strings(res.Required)
+		if def, present := g.definitions[definitionName(t)]; present && def == nil {
+			g.definitions[definitionName(t)] = res
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("%s cannot be represented in JSON", t)
+}
+
+// definitionName returns the key of the recursive type in the definitions.
+// It includes the package path, so that the types with the same name from different packages do not collide.
+func definitionName(t reflect.Type) string {
+	return t.PkgPath() + "." + t.Name()
+}
+
+func (g *schemaGenerator) addFields(res *Schema, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if jsonTag == "-" || field.Tag.Get("state") == "-" {
+			continue
+		}
+
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if field.Anonymous && ft.Kind() == reflect.Struct && strings.Split(jsonTag, ",")[0] == "" {
+			// Embedded struct fields are promoted.
+			if err := g.addFields(res, ft); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := jsonFieldName(field)
+		prop, err := g.generate(field.Type)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.Name, err)
+		}
+		required, err := applyRules(prop, field)
+		if err != nil {
+			return fmt.Errorf("bad validate tag of %s: %w", field.Name, err)
+		}
+		if tag, err := parseStateTag(field.Tag.Get("state")); err == nil && tag.name == tagId {
+			if res.StateId != "" {
+				res.StateId += ","
+			}
+			res.StateId += name
+			required = true
+		}
+		if required {
+			res.Required = append(res.Required, name)
+		}
+		res.Properties[name] = prop
+	}
+	return nil
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+// applyRules translates the validate tag of the field into the schema keywords.
+// It reports whether the field is required.
+func applyRules(s *Schema, field reflect.StructField) (bool, error) {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return false, nil
+	}
+	rules, err := parseRules(tag)
+	if err != nil {
+		return false, err
+	}
+	required := false
+	for _, r := range rules {
+		switch r.name {
+		case "required":
+			required = true
+		case "min", "max":
+			limit, err := strconv.ParseFloat(r.arg, 64)
+			if err != nil {
+				return false, err
+			}
+			setLimit(s, r.name == "min", limit)
+		case "oneof":
+			for _, option := range strings.Fields(r.arg) {
+				s.Enum = append(s.Enum, enumValue(s.Type, option))
+			}
+		case "pattern":
+			s.Pattern = "^(?:" + r.arg + ")$"
+		}
+	}
+	return required, nil
+}
+
+func setLimit(s *Schema, min bool, limit float64) {
+	n := int(limit)
+	pick := func(minPtr, maxPtr **int) {
+		if min {
+			*minPtr = &n
+		} else {
+			*maxPtr = &n
+		}
+	}
+	switch s.Type {
+	case "integer", "number":
+		if min {
+			s.Minimum = &limit
+		} else {
+			s.Maximum = &limit
+		}
+	case "string":
+		pick(&s.MinLength, &s.MaxLength)
+	case "array":
+		pick(&s.MinItems, &s.MaxItems)
+	case "object":
+		pick(&s.MinProperties, &s.MaxProperties)
+	}
+}
+
+func enumValue(schemaType, option string) interface{} {
+	switch schemaType {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(option, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(option); err == nil {
+			return b
+		}
+	}
+	return option
+}
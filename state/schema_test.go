@@ -0,0 +1,135 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaBase struct {
+	Owner string `json:"owner" validate:"required"`
+}
+
+type schemaRoom struct {
+	Name  string   `json:"name" state:"id"`
+	Area  float64  `json:"area,omitempty" validate:"min=1"`
+	Floor string   `json:"floor,omitempty" validate:"oneof=wood tile"`
+	Doors []string `json:"doors" validate:"max=2"`
+}
+
+type schemaHouse struct {
+	schemaBase
+	Rooms    []*schemaRoom   `json:"rooms"`
+	Windows  map[string]int  `json:"windows,omitempty"`
+	Built    time.Time       `json:"built"`
+	Floors   int             `json:"floors" validate:"oneof=1 2"`
+	Note     string          `state:"-"`
+	Internal string          `json:"-"`
+	Parent   *schemaHouse    `json:"parent,omitempty"`
+	Extra    interface{}     `json:"extra,omitempty"`
+	Code     string          `json:"code" validate:"pattern=[A-Z]+"`
+	Tags     map[string]bool `validate:"min=1"`
+
+	secret string
+}
+
+func TestJSONSchema(t *testing.T) {
+	s, err := JSONSchema(reflect.TypeOf(&schemaHouse{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	var want map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "additionalProperties": false,
+  "required": ["owner"],
+  "properties": {
+    "owner": {"type": "string"},
+    "rooms": {"type": "array", "items": {
+      "type": "object",
+      "additionalProperties": false,
+      "x-state-id": "name",
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string"},
+        "area": {"type": "number", "minimum": 1},
+        "floor": {"type": "string", "enum": ["wood", "tile"]},
+        "doors": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+      }
+    }},
+    "windows": {"type": "object", "additionalProperties": {"type": "integer"}},
+    "built": {"type": "string"},
+    "floors": {"type": "integer", "enum": [1, 2]},
+    "parent": {"$ref": "#/definitions/rmazur.io~1overseer~1state.schemaHouse"},
+    "extra": {},
+    "code": {"type": "string", "pattern": "^(?:[A-Z]+)$"},
+    "Tags": {"type": "object", "additionalProperties": {"type": "boolean"}, "minProperties": 1}
+  }
+}`), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	definitions := got["definitions"].(map[string]interface{})
+	delete(got, "definitions")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected schema: %s", data)
+	}
+	def := definitions["rmazur.io/overseer/state.schemaHouse"].(map[string]interface{})
+	delete(want, "$schema")
+	if !reflect.DeepEqual(def, want) {
+		t.Errorf("Unexpected definition: %v", def)
+	}
+}
+
+func TestJSONSchema_CompositeId(t *testing.T) {
+	s, err := JSONSchema(reflect.TypeOf(server{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.StateId != "Region,Name" || !reflect.DeepEqual(s.Required, []string{"Name", "Region"}) {
+		t.Errorf("Unexpected schema: %+v", s)
+	}
+
+	s, err = JSONSchema(reflect.TypeOf(pointerKey{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.StateId != "" || s.StateIdMethod != "StateId" {
+		t.Errorf("Unexpected schema: %+v", s)
+	}
+}
+
+func TestJSONSchema_Errors(t *testing.T) {
+	_, err := JSONSchema(reflect.TypeOf(struct{ C chan int }{}))
+	if err == nil || !strings.Contains(err.Error(), "C: chan int cannot be represented in JSON") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestResourceType_JSONSchema(t *testing.T) {
+	r := NewRegistry()
+	meta := Metadata{Description: "A room.", Fields: map[string]string{"Area": "Area in square meters."}}
+	if err := r.Register("Room", schemaRoom{}, meta); err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := r.Lookup("Room")
+	s, err := rt.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "Room" || s.Description != "A room." || s.Properties["area"].Description != "Area in square meters." {
+		t.Errorf("Unexpected schema: %+v", s)
+	}
+}
@@ -1,8 +1,11 @@
 package state // import rmazur.io/overseer/state
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"reflect"
+	"strings"
 )
 
 type Item interface {
@@ -25,37 +28,79 @@ func (ca ComposedAction) Do(ctx context.Context) error {
 	return nil
 }
 
+// InferActions returns the Action moving the state from prev to next.
+// If the plan cannot be computed, the returned action fails with the NewPlan error.
+// Use NewPlan to inspect the changes before performing them.
 func InferActions(prev, next Set) Action {
-	nextState := mapState(next)
-
-	removeActions := make([]Action, 0, len(prev))
-	updateActions := make([]Action, 0, len(next))
-	for _, prevItem := range prev {
-		if nextItem, present := nextState[prevItem.Id()]; present {
-			if !nextItem.IsSame(prevItem) {
-				nextItem := nextItem
-				prevItem := prevItem
-				updateActions = append(updateActions, ActionFunc(func(ctx context.Context) error {
-					return nextItem.Update(ctx, prevItem)
-				}))
+	p, err := NewPlan(prev, next)
+	if err != nil {
+		return ActionFunc(func(context.Context) error {
+			return err
+		})
+	}
+	return p
+}
+
+// InvalidItemError reports an item which cannot be planned, like a nil item or a ComposedItem without an ID.
+type InvalidItemError struct {
+	// Parent is the ID of the ComposedItem containing the item, it is empty for the top level of a Set.
+	Parent string
+	// Index is the position of the item among its siblings.
+	Index  int
+	Reason string
+}
+
+func (ie *InvalidItemError) Error() string {
+	return fmt.Sprintf("%s at %s[%d]", ie.Reason, ie.Parent, ie.Index)
+}
+
+// DuplicateIdError reports several items sharing the same ID in a Set or in the parts of a ComposedItem.
+type DuplicateIdError struct {
+	Id string
+	// Parent is the ID of the ComposedItem containing the items, it is empty for the top level of a Set.
+	Parent string
+	// Indexes are the positions of the colliding items among their siblings.
+	Indexes []int
+}
+
+func (de *DuplicateIdError) Error() string {
+	paths := make([]string, len(de.Indexes))
+	for i, index := range de.Indexes {
+		paths[i] = fmt.Sprintf("%s[%d]", de.Parent, index)
+	}
+	return fmt.Sprintf("duplicate id %s at %s", de.Id, strings.Join(paths, " and "))
+}
+
+// checkDuplicateIds looks for the items sharing the same ID at every level of the tree.
+func checkDuplicateIds(items []Item, parent string) error {
+	positions := make(map[string][]int, len(items))
+	var duplicates []string
+	for i, item := range items {
+		id := item.Id()
+		positions[id] = append(positions[id], i)
+		if len(positions[id]) == 2 {
+			duplicates = append(duplicates, id)
+		}
+	}
+	if len(duplicates) > 0 {
+		return &DuplicateIdError{Id: duplicates[0], Parent: parent, Indexes: positions[duplicates[0]]}
+	}
+	for _, item := range items {
+		if csi, ok := item.(ComposedItem); ok {
+			if err := checkDuplicateIds(csi.Parts, csi.Id()); err != nil {
+				return err
 			}
-			delete(nextState, prevItem.Id())
-		} else {
-			removeActions = append(removeActions, ActionFunc(prevItem.Remove))
 		}
 	}
+	return nil
+}
 
-	actions := make([]Action, len(removeActions)+len(updateActions)+len(nextState))
-	copy(actions, removeActions)
-	copy(actions[len(removeActions):], updateActions)
-
-	createActions := actions[len(removeActions)+len(updateActions):]
-	i := 0
-	for _, nextItem := range nextState {
-		createActions[i] = ActionFunc(nextItem.Create)
-		i++
+// checkSet tells whether the plan for the Set can be computed.
+func checkSet(items Set) error {
+	if err := checkNil(items, ""); err != nil {
+		return err
 	}
-	return ComposedAction(actions)
+	return checkDuplicateIds(items, "")
 }
 
 func mapState(items []Item) map[string]Item {
@@ -91,38 +136,53 @@ type ComposedItem struct {
 
 	actions  Actionable
 	original interface{}
+	// Type of the struct, list, or map value the item is built from.
+	valueType reflect.Type
+	replacer  Replacer
+	strategy  ReplaceStrategySelector
+	renamer   Renamer
+
+	// Set if the order of the parts is significant.
+	ordered bool
+	// Set if the parts are matched by their content rather than IDs.
+	lcs bool
+
+	// Set if a change of the item requires the replacement of its parent.
+	replace replaceMark
+
+	// Content hash cached by BuildStateItems.
+	digest []byte
 }
 
 func (csi ComposedItem) Id() string {
 	return csi.IdValue.String()
 }
 
+// sameValueType tells whether the items are built from the values of the same type. Items constructed
+// directly are not typed and match any other item.
+func sameValueType(a, b ComposedItem) bool {
+	return a.valueType == nil || b.valueType == nil || a.valueType == b.valueType
+}
+
 func (csi ComposedItem) IsSame(another Item) bool {
-	if another == nil {
-		panic(csi.Id() + " is being compared to nil")
-	}
-	if another.Id() != csi.Id() {
+	if another == nil || another.Id() != csi.Id() {
 		return false
 	}
 	if acsi, ok := another.(ComposedItem); ok {
-		if csi.actions != nil {
-			if acsi.actions == nil {
-				return false
-			}
-			if item, ok := csi.actions.(Item); ok {
-				if otherItem, ok := acsi.actions.(Item); ok {
-					if !item.IsSame(otherItem) {
-						return false
-					}
-				} else {
-					return false
-				}
-			}
-		} else if acsi.actions != nil {
+		if !sameValueType(csi, acsi) {
+			return false
+		}
+		if csi.digest != nil && bytes.Equal(csi.digest, acsi.digest) {
+			return true
+		}
+		if !sameActions(csi, acsi) {
 			return false
 		}
 
-		if len(acsi.Parts) != len(csi.Parts) {
+		if len(acsi.Parts) != len(csi.Parts) || csi.ordered != acsi.ordered {
+			return false
+		}
+		if csi.ordered && !sameOrder(csi.Parts, acsi.Parts, func(id string) string { return id }) {
 			return false
 		}
 		anotherState := mapState(acsi.Parts)
@@ -141,6 +201,32 @@ func (csi ComposedItem) IsSame(another Item) bool {
 	}
 }
 
+// sameActions compares the actions of the composed items.
+func sameActions(a, b ComposedItem) bool {
+	if a.actions == nil || b.actions == nil {
+		return a.actions == nil && b.actions == nil
+	}
+	if item, ok := a.actions.(Item); ok {
+		otherItem, ok := b.actions.(Item)
+		return ok && item.IsSame(otherItem)
+	}
+	return true
+}
+
+// sameOrder tells whether the parts with the same IDs are listed in the same order.
+// The ID of every part in a is mapped with id before the comparison.
+func sameOrder(a, b []Item, id func(string) string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if id(a[i].Id()) != b[i].Id() {
+			return false
+		}
+	}
+	return true
+}
+
 func (csi ComposedItem) Create(ctx context.Context) error {
 	if csi.actions != nil {
 		err := csi.actions.Create(ctx)
@@ -171,15 +257,20 @@ func (csi ComposedItem) Remove(ctx context.Context) error {
 func (csi ComposedItem) Update(ctx context.Context, from interface{}) error {
 	fromCsi, ok := from.(ComposedItem)
 	if !ok {
-		panic(fmt.Errorf("bad composition: %s is not a ComposedItem", from))
+		return fmt.Errorf("bad composition: %s is not a ComposedItem", from)
 	}
 	if err := InferActions(fromCsi.Parts, csi.Parts).Do(ctx); err != nil {
 		return err
 	}
+	return csi.updateSelf(ctx, fromCsi)
+}
+
+// updateSelf performs the update of the composed item itself, assuming its parts are already updated.
+func (csi ComposedItem) updateSelf(ctx context.Context, from ComposedItem) error {
 	if csi.actions != nil {
-		prev := from
-		if fromCsi.original != nil {
-			prev = fromCsi.original
+		var prev interface{} = from
+		if from.original != nil {
+			prev = from.original
 		}
 		return csi.actions.Update(ctx, prev)
 	}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -256,3 +257,44 @@ func TestStringStateItem_IsSame(t *testing.T) {
 		t.Errorf("%s should not be the same as %s", ssi1, ssi2Changed)
 	}
 }
+
+func TestDuplicateIds(t *testing.T) {
+	type room struct {
+		Name string `state:"id"`
+		Size int
+	}
+	type house struct {
+		Id    string `state:"id"`
+		Rooms []room
+	}
+
+	_, err := BuildStateItems([]house{
+		{Id: "a", Rooms: []room{{Name: "hall"}, {Name: "kitchen"}, {Name: "hall", Size: 2}}},
+	})
+	var de *DuplicateIdError
+	if !errors.As(err, &de) || de.Id != "/a/Rooms/hall" || !reflect.DeepEqual(de.Indexes, []int{0, 2}) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err.Error() != "duplicate id /a/Rooms/hall at /a/Rooms[0] and /a/Rooms[2]" {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+
+	r := new(recorder)
+	items := Set{
+		testStateItem{id: "a", arg: "1", recorder: r},
+		ComposedItem{IdValue: StringId("b"), Parts: []Item{
+			testStateItem{id: "b/c", arg: "1", recorder: r},
+			testStateItem{id: "b/c", arg: "2", recorder: r},
+		}},
+	}
+	err = InferActions(nil, items).Do(context.Background())
+	if err == nil || err.Error() != "next state: duplicate id b/c at b[0] and b[1]" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := NewPlan(Set{items[0], items[0]}, nil); err == nil || !strings.HasPrefix(err.Error(), "previous state: duplicate id a") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(*r) != 0 {
+		t.Errorf("Actions are performed: %s", r)
+	}
+}
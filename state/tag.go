@@ -0,0 +1,146 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Reserved names of the state field tag. Other names refer to the parent update methods.
+const (
+	tagSkip    = "-"
+	tagId      = "id"
+	tagReplace = "replace"
+	tagOrdered = "ordered"
+	tagLcs     = "lcs"
+)
+
+// Options of the state field tag.
+const (
+	// optionCreateFirst selects CreateBeforeRemove for the replacement forced with the field.
+	optionCreateFirst = "create-before-remove"
+	// optionOrdered makes the order of the list elements significant, the list is updated with the parent method
+	// set with the tag name, like `state:"Reorder,ordered"`.
+	optionOrdered = "ordered"
+	// optionCmp names the comparator of the field values registered with RegisterNamedComparator,
+	// like `state:"cmp=fold"`.
+	optionCmp = "cmp"
+)
+
+// stateTag is a parsed state field tag: a name followed by comma separated options,
+// like `state:"replace,create-before-remove"`.
+type stateTag struct {
+	name    string
+	options []string
+}
+
+// Options may have values, like `state:"Write,cmp=fold"`, the name can be omitted before them.
+func parseStateTag(tag string) (stateTag, error) {
+	parts := strings.Split(tag, ",")
+	res := stateTag{name: parts[0], options: parts[1:]}
+	if strings.Contains(res.name, "=") {
+		res.name, res.options = "", parts
+	}
+	for _, option := range res.options {
+		valid := false
+		key, value := splitOption(option)
+		switch key {
+		case optionCreateFirst:
+			valid = res.name == tagReplace && value == ""
+		case optionOrdered:
+			valid = updateMethodName(res.name) != "" && value == ""
+		case optionCmp:
+			valid = res.name != tagSkip && res.name != tagId && value != ""
+		}
+		if !valid {
+			return res, fmt.Errorf("unknown option %q of %q", option, res.name)
+		}
+	}
+	return res, nil
+}
+
+// ordered tells whether the tag makes the order of the list elements significant.
+func (st stateTag) ordered() bool {
+	return st.name == tagOrdered || st.has(optionOrdered)
+}
+
+func splitOption(option string) (key, value string) {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return option, ""
+}
+
+// value returns the value of the option in the key=value form.
+func (st stateTag) value(key string) string {
+	for _, o := range st.options {
+		if k, v := splitOption(o); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+func (st stateTag) has(option string) bool {
+	for _, o := range st.options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// updateMethodName returns the name of the parent update method set with the state field tag name.
+func updateMethodName(name string) string {
+	switch name {
+	case "", tagSkip, tagId, tagReplace, tagOrdered, tagLcs:
+		return ""
+	}
+	return name
+}
+
+// replaceMark is set on the items built from the fields tagged with `state:"replace"`.
+type replaceMark struct {
+	forced bool
+	// strategy is set with the tag option, nil selects the item or the plan default.
+	strategy *ReplaceStrategy
+}
+
+func (st stateTag) replaceMark() replaceMark {
+	res := replaceMark{forced: true}
+	if st.has(optionCreateFirst) {
+		strategy := CreateBeforeRemove
+		res.strategy = &strategy
+	}
+	return res
+}
+
+// markReplace flags the item built from a field tagged with `state:"replace"`.
+func markReplace(item Item, mark replaceMark) Item {
+	switch it := item.(type) {
+	case valueStateItem:
+		it.replace = mark
+		return it
+	case ComposedItem:
+		it.replace = mark
+		return it
+	}
+	return item
+}
+
+// replaceMarkOf returns the mark telling whether a change of the items requires the replacement of their parent.
+func replaceMarkOf(items ...Item) replaceMark {
+	for _, item := range items {
+		switch it := item.(type) {
+		case valueStateItem:
+			if it.replace.forced {
+				return it.replace
+			}
+		case ComposedItem:
+			if it.replace.forced {
+				return it.replace
+			}
+		}
+	}
+	return replaceMark{}
+}
@@ -0,0 +1,263 @@
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a struct field value violating its validation rule.
+type FieldError struct {
+	// Path is the ID of the field value, like /Bedrooms/bedroom 1/Space/Area.
+	Path string
+	// Rule is the violated rule, like min=1.
+	Rule    string
+	Message string
+}
+
+func (fe *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", fe.Path, fe.Message)
+}
+
+// ValidationError is returned by BuildStateItems when the input violates the rules defined with the `validate`
+// field tags. It lists all the violations.
+//
+// The supported rules are separated with commas:
+//
+//	required     the value must not be zero, slices and maps must not be empty
+//	min=n        numbers must not be less than n, strings, slices and maps must have at least n elements
+//	max=n        numbers must not be greater than n, strings, slices and maps must have at most n elements
+//	oneof=a b c  the value must be formatted as one of the space separated words
+//	pattern=re   strings must fully match the regular expression; the rule must be the last one in the tag
+//
+// Rules other than required are not checked for nil pointers.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (ve *ValidationError) Error() string {
+	msgs := make([]string, len(ve.Errors))
+	for i, fe := range ve.Errors {
+		msgs[i] = fe.Error()
+	}
+	return "invalid state: " + strings.Join(msgs, "; ")
+}
+
+// violation is a FieldError with the path resolved after the IDs are injected.
+type violation struct {
+	id      *valueId
+	rule    string
+	message string
+}
+
+func (b *builder) validationError() error {
+	if len(b.violations) == 0 {
+		return nil
+	}
+	res := &ValidationError{Errors: make([]*FieldError, len(b.violations))}
+	for i, v := range b.violations {
+		res.Errors[i] = &FieldError{Path: v.id.String(), Rule: v.rule, Message: v.message}
+	}
+	return res
+}
+
+// validate checks the field value against the rules from its validate tag.
+// Violations are recorded, while malformed rules are returned as errors.
+func (b *builder) validate(v reflect.Value, field reflect.StructField, id *valueId) error {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return nil
+	}
+	rules, err := parseRules(tag)
+	if err != nil {
+		return fmt.Errorf("bad validate tag of %s: %w", field.Name, err)
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	for _, r := range rules {
+		msg, err := r.check(v)
+		if err != nil {
+			return fmt.Errorf("bad validate tag of %s: %s: %w", field.Name, r.text, err)
+		}
+		if msg != "" {
+			b.violations = append(b.violations, violation{id: id, rule: r.text, message: msg})
+		}
+	}
+	return nil
+}
+
+// validateFields checks the fields of the struct v and the nested values that are not split into the state parts,
+// as they are compared as a whole.
+func (b *builder) validateFields(v reflect.Value, id *valueId) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldId := id.next(field.Name)
+		if err := b.validate(v.Field(i), field, fieldId); err != nil {
+			return err
+		}
+		if err := b.validateNested(v.Field(i), fieldId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *builder) validateNested(v reflect.Value, id *valueId) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		leave, err := b.enter(v, id)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if structId, ok := structId(v); ok {
+			var err error
+			if id, err = id.inject(structId); err != nil {
+				return err
+			}
+		}
+		return b.validateFields(v, id)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := b.validateNested(v.Index(i), id.nextListId(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys, err := mapKeys(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		for _, k := range keys {
+			if err := b.validateNested(v.MapIndex(k.value), id.next(k.id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type rule struct {
+	text, name, arg string
+}
+
+func parseRules(tag string) ([]rule, error) {
+	var res []rule
+	for tag != "" {
+		text := tag
+		if strings.HasPrefix(tag, "pattern=") {
+			tag = ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			text, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+		r := rule{text: text, name: text}
+		if i := strings.IndexByte(text, '='); i >= 0 {
+			r.name, r.arg = text[:i], text[i+1:]
+		}
+		switch r.name {
+		case "required":
+		case "min", "max", "oneof", "pattern":
+			if r.arg == "" {
+				return nil, fmt.Errorf("rule %s has no argument", r.name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule %q", text)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// check returns the message describing the violation, or an empty string if the value satisfies the rule.
+func (r rule) check(v reflect.Value) (string, error) {
+	if r.name == "required" {
+		if isEmpty(v) {
+			return "value is required", nil
+		}
+		return "", nil
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return "", nil
+	}
+
+	switch r.name {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(r.arg, 64)
+		if err != nil {
+			return "", err
+		}
+		n, what, err := measure(v)
+		if err != nil {
+			return "", err
+		}
+		if r.name == "min" && n < limit {
+			return fmt.Sprintf("%s %v is less than %s", what, n, r.arg), nil
+		}
+		if r.name == "max" && n > limit {
+			return fmt.Sprintf("%s %v is greater than %s", what, n, r.arg), nil
+		}
+	case "oneof":
+		value := fmt.Sprint(v.Interface())
+		for _, option := range strings.Fields(r.arg) {
+			if value == option {
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("value %q is not one of %s", value, r.arg), nil
+	case "pattern":
+		if v.Kind() != reflect.String {
+			return "", fmt.Errorf("%s is not a string", v.Type())
+		}
+		re, err := regexp.Compile("^(?:" + r.arg + ")$")
+		if err != nil {
+			return "", err
+		}
+		if !re.MatchString(v.String()) {
+			return fmt.Sprintf("value %q does not match %s", v.String(), r.arg), nil
+		}
+	}
+	return "", nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// measure returns the number compared with the min and max rules, and its description.
+func measure(v reflect.Value) (float64, string, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), "value", nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), "value", nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), "value", nil
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), "length", nil
+	}
+	return 0, "", fmt.Errorf("%s has no length", v.Type())
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type validatedSpace struct {
+	Area  float64 `validate:"min=1,max=100"`
+	Floor string  `validate:"oneof=wood tile"`
+}
+
+type validatedRoom struct {
+	Name  string `state:"id" validate:"required"`
+	Space *validatedSpace
+}
+
+type validatedHouse struct {
+	Owner    string           `validate:"required,pattern=[a-z]+( [a-z]+)?"`
+	Bedrooms []*validatedRoom `validate:"min=1"`
+	Windows  map[string]int   `validate:"max=2"`
+	Note     *string          `state:"-" validate:"max=3"`
+}
+
+func TestBuildStateItems_Validation(t *testing.T) {
+	valid := validatedHouse{
+		Owner:    "john doe",
+		Bedrooms: []*validatedRoom{{Name: "bedroom 1", Space: &validatedSpace{Area: 20, Floor: "wood"}}},
+	}
+	if _, err := BuildStateItems(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := validatedHouse{
+		Owner: "John",
+		Bedrooms: []*validatedRoom{
+			{Name: "bedroom 1", Space: &validatedSpace{Area: 0.5, Floor: "wood"}},
+			{Space: &validatedSpace{Area: 200, Floor: "carpet"}},
+		},
+		Windows: map[string]int{"a": 1, "b": 2, "c": 3},
+	}
+	_, err := BuildStateItems(invalid)
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var got []string
+	for _, fe := range ve.Errors {
+		got = append(got, fe.Path+" "+fe.Rule)
+	}
+	want := []string{
+		"/Owner pattern=[a-z]+( [a-z]+)?",
+		"/Bedrooms/bedroom 1/Space/Area min=1",
+		"/Bedrooms//Name required",
+		"/Bedrooms//Space/Area max=100",
+		"/Bedrooms//Space/Floor oneof=wood tile",
+		"/Windows max=2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected violations:\ngot  %q\nwant %q", got, want)
+	}
+	if !strings.Contains(err.Error(), "/Bedrooms/bedroom 1/Space/Area: value 0.5 is less than 1") {
+		t.Errorf("Unexpected error message: %s", err)
+	}
+}
+
+func TestBuildStateItems_BadValidateTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   interface{}
+		wantErr string
+	}{
+		{name: "unknown rule", input: struct {
+			A string `validate:"short"`
+		}{}, wantErr: `bad validate tag of A: unknown rule "short"`},
+		{name: "no argument", input: struct {
+			A string `validate:"min="`
+		}{}, wantErr: "bad validate tag of A: rule min has no argument"},
+		{name: "bad number", input: struct {
+			A int `validate:"max=x"`
+		}{}, wantErr: "bad validate tag of A: max=x"},
+		{name: "bad pattern", input: struct {
+			A string `validate:"pattern=("`
+		}{}, wantErr: "bad validate tag of A: pattern=("},
+		{name: "no length", input: struct {
+			A bool `validate:"min=1"`
+		}{}, wantErr: "bool has no length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BuildStateItems(tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Unexpected error: %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}